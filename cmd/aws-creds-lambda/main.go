@@ -2,39 +2,250 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
 	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
 	handler "github.com/michaelw/aws-oidc-cli/internal/handler"
 	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+	"github.com/michaelw/aws-oidc-cli/internal/secrets"
 )
 
 func main() {
 	log.SetFlags(log.Lshortfile) // Disable timestamp and other prefixes
 	ctx := context.Background()
 
-	issuer := os.Getenv("OIDC_ISSUER")
-	clientID := os.Getenv("OIDC_CLIENT_ID")
-	clientSecret := os.Getenv("OIDC_CLIENT_SECRET")
-	provider, err := coreosoidc.NewProvider(ctx, issuer)
+	stsClient, err := awsutils.NewSTSClient(ctx)
 	if err != nil {
-		log.Fatalf("failed to initialize OIDC provider: %v", err)
+		log.Fatalf("failed to initialize STS client: %v", err)
 	}
-	oidcClient := oidc.NewOIDCClient(
-		provider,
-		clientID,
-		clientSecret,
-	)
 
-	stsClient, err := awsutils.NewSTSClient(ctx)
+	awsCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		log.Fatalf("failed to initialize STS client: %v", err)
+		log.Fatalf("failed to load AWS configuration: %v", err)
+	}
+	secretRefresh := defaultSecretRefreshInterval
+	if raw := os.Getenv("SECRET_REFRESH_INTERVAL"); raw != "" {
+		if secretRefresh, err = time.ParseDuration(raw); err != nil {
+			log.Fatalf("invalid SECRET_REFRESH_INTERVAL: %v", err)
+		}
+	}
+	resolver := secrets.NewResolver(secrets.DefaultSources(awsCfg), secretRefresh)
+	stateKey := os.Getenv("STATE_SIGNING_KEY")
+	if _, err := resolver.Resolve(ctx, stateKey); err != nil {
+		log.Printf("STATE_SIGNING_KEY: %v", err)
+	}
+
+	discoveryRefresh := defaultDiscoveryRefreshInterval
+	if raw := os.Getenv("DISCOVERY_REFRESH_INTERVAL"); raw != "" {
+		if discoveryRefresh, err = time.ParseDuration(raw); err != nil {
+			log.Fatalf("invalid DISCOVERY_REFRESH_INTERVAL: %v", err)
+		}
+	}
+
+	requirePAR, err := parseBool(os.Getenv("REQUIRE_PAR"))
+	if err != nil {
+		log.Fatalf("invalid REQUIRE_PAR: %v", err)
+	}
+
+	requireDPoP, err := parseBool(os.Getenv("REQUIRE_DPOP"))
+	if err != nil {
+		log.Fatalf("invalid REQUIRE_DPOP: %v", err)
+	}
+
+	allowPlaintext, err := parseBool(os.Getenv("ALLOW_PLAINTEXT_CREDENTIALS"))
+	if err != nil {
+		log.Fatalf("invalid ALLOW_PLAINTEXT_CREDENTIALS: %v", err)
+	}
+
+	auditSink, err := audit.ParseSinks(splitList(os.Getenv("AUDIT_SINKS")))
+	if err != nil {
+		log.Fatalf("failed to initialize audit sinks: %v", err)
+	}
+
+	var rules []handler.RoleRule
+	if raw := os.Getenv("ROLE_RULES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+			log.Fatalf("invalid ROLE_RULES: %v", err)
+		}
+	}
+
+	var sessionTags []handler.SessionTag
+	if raw := os.Getenv("SESSION_TAGS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &sessionTags); err != nil {
+			log.Fatalf("invalid SESSION_TAGS: %v", err)
+		}
+	}
+
+	cfg := handler.Config{
+		AllowedRedirectURIs: splitList(os.Getenv("ALLOWED_REDIRECT_URIS")),
+		RequirePAR:          requirePAR,
+		RequireDPoP:         requireDPoP,
+		PublicURL:           os.Getenv("PUBLIC_URL"),
+
+		AllowPlaintextCredentials: allowPlaintext,
+		Audit:                     auditSink,
+		SessionNameTemplate:       os.Getenv("SESSION_NAME_TEMPLATE"),
+		SourceIdentityClaim:       os.Getenv("SOURCE_IDENTITY_CLAIM"),
+		Rules:                     rules,
+		HubRoleARN:                os.Getenv("HUB_ROLE_ARN"),
+		ExternalID:                os.Getenv("EXTERNAL_ID"),
+		SessionTags:               sessionTags,
+		AllowedPrompts:            splitList(os.Getenv("ALLOWED_PROMPTS")),
+		AllowedACRValues:          splitList(os.Getenv("ALLOWED_ACR_VALUES")),
+		AllowedScopes:             splitList(os.Getenv("ALLOWED_SCOPES")),
+	}
+	var named map[string]handler.IssuerConfig
+	if raw := os.Getenv("OIDC_ISSUERS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &named); err != nil {
+			log.Fatalf("invalid OIDC_ISSUERS: %v", err)
+		}
 	}
 
-	h := handler.NewAwsCredsHandler(oidcClient, stsClient)
-	lambda.Start(h.Serve)
+	env := issuerEnv{sts: stsClient, secrets: resolver, stateKey: stateKey, base: cfg}
+	issuers := handler.NewIssuers()
+	issuers.RefreshInterval = discoveryRefresh
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		env.add(ctx, issuers, defaultIssuer, handler.IssuerConfig{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			ClientKey:    os.Getenv("OIDC_CLIENT_KEY"),
+			Scopes:       splitList(os.Getenv("OIDC_SCOPES")),
+		})
+		issuers.Default = defaultIssuer
+	}
+	for name, ic := range named {
+		env.add(ctx, issuers, name, ic)
+	}
+	if issuers.Default == "" && len(named) == 0 {
+		log.Fatalf("no issuer configured: set OIDC_ISSUER or OIDC_ISSUERS")
+	}
+
+	lambda.Start(issuers.Serve)
+}
+
+// defaultIssuer names the issuer configured with OIDC_ISSUER.
+const defaultIssuer = "default"
+
+// defaultSecretRefreshInterval is how long resolved secret references are
+// cached before they are fetched again.
+const defaultSecretRefreshInterval = 5 * time.Minute
+
+// defaultDiscoveryRefreshInterval is how often OIDC discovery is repeated
+// for initialized issuers.
+const defaultDiscoveryRefreshInterval = time.Hour
+
+// issuerEnv holds what all issuers share.
+type issuerEnv struct {
+	sts     awsutils.STSClient
+	secrets *secrets.Resolver
+	// stateKey is STATE_SIGNING_KEY, if set, which may be a secret reference.
+	stateKey string
+	base     handler.Config
+}
+
+// add registers an issuer whose OIDC provider is discovered on first use.
+// Its client secret is resolved now to warm the cache, but a failure only
+// affects this issuer.
+func (e issuerEnv) add(ctx context.Context, issuers *handler.Issuers, name string, ic handler.IssuerConfig) {
+	cfg := ic.Config(e.base)
+	cfg.Provider = name
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("issuer %s: invalid configuration: %v", name, err)
+	}
+	// The client key, if any, replaces the secret for client authentication
+	// and state key derivation
+	credential := cmp.Or(ic.ClientKey, ic.ClientSecret)
+	// A key derived from a credential that rotates would change under logins
+	// in flight, and differ between instances until every cache has refreshed
+	if e.stateKey == "" && e.secrets.IsRef(credential) {
+		log.Fatalf("issuer %s: STATE_SIGNING_KEY is required when the client credential is a secret reference", name)
+	}
+	if _, err := e.secrets.Resolve(ctx, credential); err != nil {
+		log.Printf("issuer %s: %v", name, err)
+	}
+	if ic.ClientKey != "" {
+		cfg.ClientKeys = func(ctx context.Context) ([]oidc.SigningKey, error) {
+			pem, err := e.secrets.Resolve(ctx, ic.ClientKey)
+			if err != nil {
+				return nil, err
+			}
+			return oidc.ParseSigningKeys([]byte(pem))
+		}
+	}
+	err := issuers.Add(name, func(ctx context.Context) (*handler.AwsCredsHandler, error) {
+		secret, err := e.secrets.Resolve(ctx, credential)
+		if err != nil {
+			return nil, err
+		}
+		stateKey, err := e.secrets.Resolve(ctx, e.stateKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.StateKey, err = stateSigningKey(stateKey, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive state signing key: %w", err)
+		}
+		provider, err := coreosoidc.NewProvider(ctx, ic.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize OIDC provider: %w", err)
+		}
+		var oidcClient oidc.OIDCClient
+		if cfg.ClientKeys != nil {
+			oidcClient = oidc.NewOIDCClientWithKeys(provider, ic.ClientID, cfg.ClientKeys, ic.Scopes...)
+		} else {
+			oidcClient = oidc.NewOIDCClientWithSecret(provider, ic.ClientID, e.secrets.Func(ic.ClientSecret), ic.Scopes...)
+		}
+		return handler.NewAwsCredsHandler(oidcClient, e.sts, cfg), nil
+	})
+	if err != nil {
+		log.Fatalf("invalid OIDC_ISSUERS: %v", err)
+	}
+}
+
+// splitList splits a comma-separated environment value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseBool parses a boolean environment value, treating empty as false.
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// stateSigningKey returns the configured state signing key, or derives one
+// from the client secret, or client key, so that all Lambda instances agree
+// on it.
+func stateSigningKey(configured, clientSecret string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	if clientSecret == "" {
+		return nil, errors.New("no client secret to derive it from; set STATE_SIGNING_KEY")
+	}
+	return hkdf.Key(sha256.New, []byte(clientSecret), nil, "aws-oidc state signing key", sha256.Size)
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/browser"
+)
+
+// Values of --browser; any other value is a command.
+const (
+	browserAuto = "auto" // the system's default browser
+	browserNone = "none" // the user opens the URL and may paste the redirect
+)
+
+func init() {
+	// Stdout is reserved for the credentials
+	browser.Stdout = os.Stderr
+}
+
+// openBrowser opens u with the system's default browser in auto mode, or
+// runs mode as a command with u as its last argument.
+func openBrowser(mode, u string) error {
+	if mode == browserAuto {
+		return browser.OpenURL(u)
+	}
+	args := strings.Fields(mode)
+	if len(args) == 0 {
+		return errors.New("empty browser command")
+	}
+	cmd := exec.Command(args[0], append(args[1:], u)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// stdinLines returns the lines read from stdin.  A single reader serves all
+// logins, so that a step-up login does not compete with the first.
+var stdinLines = sync.OnceValue(func() <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+})
+
+// readPastedCallback reads redirect URLs or codes pasted into stdin until one
+// is valid for the login with state, which it sends to results, or ctx is
+// done.  signedState is the envelope /auth returned, if any.
+func readPastedCallback(ctx context.Context, state, signedState string, results chan<- callbackResult) {
+	for {
+		var line string
+		select {
+		case <-ctx.Done():
+			return
+		case l, ok := <-stdinLines():
+			if !ok {
+				return
+			}
+			line = strings.TrimSpace(l)
+		}
+		if line == "" {
+			continue
+		}
+		result, err := parsePastedCallback(line, state, signedState)
+		if err != nil {
+			log.Printf("%v; paste the URL your browser was redirected to, or the code from it", err)
+			continue
+		}
+		select {
+		case results <- result:
+		default:
+		}
+		return
+	}
+}
+
+// parsePastedCallback parses a pasted redirect URL, just its query, or the
+// code from it, and checks it like a redirect to the callback.  A bare code
+// is paired with signedState, the envelope /auth returned.
+func parsePastedCallback(s, state, signedState string) (callbackResult, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(s, "?"))
+	if u, uerr := url.Parse(s); uerr == nil && u.RawQuery != "" {
+		query, err = u.Query(), nil
+	}
+	if err != nil || !query.Has("state") && !query.Has("code") && !query.Has("error") {
+		if signedState == "" {
+			return callbackResult{}, errors.New("the server did not return the state, so the code alone is not enough")
+		}
+		code := s
+		if unescaped, err := url.QueryUnescape(s); err == nil && strings.Contains(s, "%") {
+			code = unescaped
+		}
+		query = url.Values{"code": {code}, "state": {signedState}}
+	}
+	return parseCallback(query, state)
+}
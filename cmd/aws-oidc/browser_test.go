@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenBrowser_EmptyCommand(t *testing.T) {
+	for _, mode := range []string{"", " ", "\t"} {
+		assert.EqualError(t, openBrowser(mode, "https://idp.example.com/authorize"), "empty browser command", "%q", mode)
+	}
+}
+
+func TestParsePastedCallback(t *testing.T) {
+	signed := signedTestState(t, "s1")
+	other := signedTestState(t, "s2")
+	query := url.Values{"state": {signed}, "code": {"c1"}}.Encode()
+	cases := []struct {
+		name        string
+		pasted      string
+		signedState string
+		code        string
+		err         string
+	}{
+		{"full URL", "http://127.0.0.1:8400/creds?" + query, "", "c1", ""},
+		{"bare query", query, "", "c1", ""},
+		{"query with ?", "?" + query, "", "c1", ""},
+		{"wrong state", "http://127.0.0.1:8400/creds?" + url.Values{"state": {other}, "code": {"c1"}}.Encode(), signed, "", "invalid state"},
+		{"missing code", "http://127.0.0.1:8400/creds?state=" + signed, signed, "", "missing code"},
+		{"bare code", "c1", signed, "c1", ""},
+		{"escaped code", "c1%2Fx", signed, "c1/x", ""},
+		{"bare code, wrong state", "c1", other, "", "invalid state"},
+		{"bare code without state", "c1", "", "", "the server did not return the state, so the code alone is not enough"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := parsePastedCallback(c.pasted, "s1", c.signedState)
+			if c.err != "" {
+				assert.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.code, result.Code)
+			assert.Equal(t, signed, result.State)
+		})
+	}
+}
+
+// TestParsePastedCallback_SameAsRedirect checks that pasted redirects are
+// validated exactly like those reaching the callback.
+func TestParsePastedCallback_SameAsRedirect(t *testing.T) {
+	signed := signedTestState(t, "s1")
+	for _, query := range []url.Values{
+		{"state": {signed}, "code": {"c1"}},
+		{"state": {signedTestState(t, "s2")}, "code": {"c1"}},
+		{"state": {"not-a-jwt"}, "code": {"c1"}},
+		{"state": {signed}},
+		{"state": {signed}, "error": {"access_denied"}, "error_description": {"User cancelled"}},
+		{"code": {"c1"}, "error": {"access_denied"}},
+	} {
+		want, wantErr := parseCallback(query, "s1")
+		got, err := parsePastedCallback("http://127.0.0.1:8400/creds?"+query.Encode(), "s1", signed)
+		assert.Equal(t, wantErr, err, query.Encode())
+		assert.Equal(t, want, got, query.Encode())
+	}
+}
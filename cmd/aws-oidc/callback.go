@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/michaelw/aws-oidc-cli/internal/handler"
+)
+
+// callbackPath is the path of the loopback redirect URI; the backend only
+// accepts loopback redirects to this path.
+const callbackPath = "/creds"
+
+// loopbackHosts are tried in order; IPv6 is the fallback for hosts without
+// an IPv4 loopback interface.
+var loopbackHosts = []string{"127.0.0.1", "::1"}
+
+// listenCallback listens on a loopback address for the OIDC redirect and
+// returns the listener with the redirect URI for the port actually bound.
+// ports is empty for a port chosen by the OS, or a fixed port or range such
+// as 8400 or 8400-8409, for IdPs that require redirect URIs to be registered
+// exactly; the first free port is used.
+func listenCallback(ports string) (net.Listener, string, error) {
+	lo, hi, err := parsePorts(ports)
+	if err != nil {
+		return nil, "", err
+	}
+	var errs []error
+	for _, host := range loopbackHosts {
+		for port := lo; port <= hi; port++ {
+			l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			redirectURI := url.URL{
+				Scheme: "http",
+				Host:   l.Addr().String(),
+				Path:   callbackPath,
+			}
+			return l, redirectURI.String(), nil
+		}
+	}
+	return nil, "", fmt.Errorf("failed to listen for the login callback: %w", errors.Join(errs...))
+}
+
+// parsePorts parses a port or port range; empty selects port 0.
+func parsePorts(s string) (lo, hi int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if lo, err = parsePort(first); err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if hi, err = parsePort(last); err != nil {
+		return 0, 0, err
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("invalid callback port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid callback port %q", s)
+	}
+	return port, nil
+}
+
+// errInvalidState rejects callbacks that do not belong to this login, e.g.
+// from a stale browser tab.
+var errInvalidState = errors.New("invalid state")
+
+// callbackResult is what the local redirect handler receives from the IdP.
+type callbackResult struct {
+	Code  string
+	State string // signed state envelope, passed back to /creds
+	Err   error  // set if the IdP returned an error instead of a code
+}
+
+// loginError is an OAuth error response from the IdP (RFC 6749, section
+// 4.1.2.1), e.g. access_denied when the user cancels the login.
+type loginError struct {
+	Code        string
+	Description string
+}
+
+func (e *loginError) Error() string {
+	if e.Description == "" {
+		return "login failed: " + e.Code
+	}
+	return fmt.Sprintf("login failed: %s: %s", e.Code, e.Description)
+}
+
+// parseCallback checks the query of a redirect to the callback against
+// state, the value this login sent to /auth.  The server wraps it into a
+// signed envelope; only the embedded value can be checked here, the server
+// verifies the signature.  Error responses must carry the state too, so
+// that other pages cannot abort the login.
+func parseCallback(query url.Values, state string) (callbackResult, error) {
+	signedState := query.Get("state")
+	claims, err := handler.ParseStateUnverified(signedState)
+	if err != nil || claims.State != state {
+		return callbackResult{}, errInvalidState
+	}
+	if code := query.Get("error"); code != "" {
+		return callbackResult{Err: &loginError{Code: code, Description: query.Get("error_description")}}, nil
+	}
+	code := query.Get("code")
+	if code == "" {
+		return callbackResult{}, errors.New("missing code")
+	}
+	return callbackResult{Code: code, State: signedState}, nil
+}
+
+// callbackHandler handles redirects to the callback for the login with
+// state and sends the first valid result to results.
+func callbackHandler(state string, results chan<- callbackResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := parseCallback(r.URL.Query(), state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var le *loginError
+		if errors.As(result.Err, &le) {
+			msg := "Login failed: " + html.EscapeString(le.Code)
+			if le.Description != "" {
+				msg += "<br>" + html.EscapeString(le.Description)
+			}
+			fmt.Fprintf(w, authCompleteHTML, msg+"<br><br>You may close this window and try again.")
+		} else {
+			fmt.Fprintf(w, authCompleteHTML, "Authentication complete.  You may close this window.")
+		}
+		// Later redirects, e.g. from a reloaded tab, are ignored
+		select {
+		case results <- result:
+		default:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePorts(t *testing.T) {
+	cases := []struct {
+		in     string
+		lo, hi int
+		err    bool
+	}{
+		{"", 0, 0, false},
+		{"8400", 8400, 8400, false},
+		{"8400-8409", 8400, 8409, false},
+		{" 8400 - 8409 ", 8400, 8409, false},
+		{"8409-8400", 0, 0, true},
+		{"0", 0, 0, true},
+		{"65536", 0, 0, true},
+		{"8400-", 0, 0, true},
+		{"http", 0, 0, true},
+	}
+	for _, c := range cases {
+		lo, hi, err := parsePorts(c.in)
+		if c.err {
+			assert.Error(t, err, c.in)
+			continue
+		}
+		require.NoError(t, err, c.in)
+		assert.Equal(t, c.lo, lo, c.in)
+		assert.Equal(t, c.hi, hi, c.in)
+	}
+}
+
+// boundPort returns the port of the redirect URI and checks that it is the
+// port l listens on.
+func boundPort(t *testing.T, l net.Listener, redirectURI string) int {
+	t.Helper()
+	u, err := url.Parse(redirectURI)
+	require.NoError(t, err)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, callbackPath, u.Path)
+	assert.True(t, net.ParseIP(u.Hostname()).IsLoopback(), redirectURI)
+	assert.Equal(t, l.Addr().String(), u.Host)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	return port
+}
+
+func TestListenCallback(t *testing.T) {
+	l, redirectURI, err := listenCallback("")
+	require.NoError(t, err)
+	port := boundPort(t, l, redirectURI)
+	assert.NotZero(t, port)
+	l.Close()
+
+	t.Run("fixed port", func(t *testing.T) {
+		l, redirectURI, err := listenCallback(strconv.Itoa(port))
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, fmt.Sprintf("http://127.0.0.1:%d/creds", port), redirectURI)
+
+		// With the IPv4 port taken, only IPv6 loopback is left
+		l6, redirectURI, err := listenCallback(strconv.Itoa(port))
+		if err == nil {
+			defer l6.Close()
+			assert.Equal(t, fmt.Sprintf("http://[::1]:%d/creds", port), redirectURI)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := listenCallback("9-3")
+		assert.ErrorContains(t, err, "invalid callback port range")
+	})
+}
+
+// signedTestState returns a state envelope for state as the server would
+// issue it; the CLI does not verify its signature.
+func signedTestState(t *testing.T, state string) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"state": state}).SignedString([]byte("test-key"))
+	require.NoError(t, err)
+	return s
+}
+
+func TestParseCallback(t *testing.T) {
+	signed := signedTestState(t, "s1")
+	cases := []struct {
+		name  string
+		query url.Values
+		code  string
+		err   string
+		idp   string
+	}{
+		{"code", url.Values{"state": {signed}, "code": {"c1"}}, "c1", "", ""},
+		{"state mismatch", url.Values{"state": {signedTestState(t, "s2")}, "code": {"c1"}}, "", "invalid state", ""},
+		{"unsigned state", url.Values{"state": {"s1"}, "code": {"c1"}}, "", "invalid state", ""},
+		{"error without state", url.Values{"error": {"access_denied"}}, "", "invalid state", ""},
+		{"error", url.Values{"state": {signed}, "error": {"access_denied"}}, "", "", "login failed: access_denied"},
+		{"error with description", url.Values{"state": {signed}, "error": {"access_denied"}, "error_description": {"User cancelled"}}, "", "", "login failed: access_denied: User cancelled"},
+		{"missing code", url.Values{"state": {signed}}, "", "missing code", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := parseCallback(c.query, "s1")
+			if c.err != "" {
+				assert.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.code, result.Code)
+			if c.idp != "" {
+				var le *loginError
+				require.True(t, errors.As(result.Err, &le))
+				assert.EqualError(t, le, c.idp)
+				return
+			}
+			assert.NoError(t, result.Err)
+			assert.Equal(t, signed, result.State)
+		})
+	}
+}
+
+func TestCallbackHandler(t *testing.T) {
+	signed := signedTestState(t, "s1")
+	results := make(chan callbackResult, 1)
+	h := callbackHandler("s1", results)
+	get := func(query url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, callbackPath+"?"+query.Encode(), nil))
+		return w
+	}
+
+	w := get(url.Values{"state": {"forged"}, "error": {"access_denied"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, results, "invalid callbacks do not end the login")
+
+	w = get(url.Values{"state": {signed}, "error": {"access_denied"}, "error_description": {"<script>alert(1)</script>"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login failed: access_denied<br>&lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.NotContains(t, w.Body.String(), "<script>alert")
+
+	// A reloaded tab does not block or replace the first result
+	w = get(url.Values{"state": {signed}, "code": {"c1"}})
+	assert.Contains(t, w.Body.String(), "Authentication complete.")
+	require.Len(t, results, 1)
+	result := <-results
+	assert.EqualError(t, result.Err, "login failed: access_denied: <script>alert(1)</script>")
+	assert.Empty(t, results)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/michaelw/aws-oidc-cli/internal/handler"
+)
+
+// exitFailure is the exit code for errors without a more specific one.
+const exitFailure = 1
+
+// serverErrors describes the backend's error codes for users, with a
+// distinct exit code for each, so that scripts can tell them apart.
+var serverErrors = map[string]struct {
+	exitCode int
+	summary  string
+}{
+	handler.ErrInvalidRequest:      {10, "the request was rejected"},
+	handler.ErrInvalidState:        {11, "the login could not be verified; try again"},
+	handler.ErrInvalidDPoP:         {12, "the request could not be verified; check the system clock"},
+	handler.ErrInvalidGrant:        {13, "the IdP rejected the authorization code, which may have expired; try again"},
+	handler.ErrInvalidToken:        {14, "the IdP's ID token is invalid"},
+	handler.ErrClaimsRejected:      {15, "your identity lacks attributes the server requires"},
+	handler.ErrStepUpRequired:      {16, "the role requires stronger authentication"},
+	handler.ErrAccessDenied:        {17, "AWS denied access to the role; check that its trust policy allows your identity"},
+	handler.ErrIdentityRejected:    {18, "AWS rejected your identity token"},
+	handler.ErrThrottled:           {19, "too many requests; try again later"},
+	handler.ErrIdPError:            {20, "the IdP failed"},
+	handler.ErrSTSError:            {21, "AWS STS failed"},
+	handler.ErrProviderUnavailable: {22, "the provider is temporarily unavailable; try again later"},
+	handler.ErrNotFound:            {23, "the server does not know this endpoint or provider; check api_url and issuer"},
+	handler.ErrInternal:            {24, "the server failed"},
+}
+
+// serverError is an error response from the backend.
+type serverError struct {
+	Status     int
+	RetryAfter string
+	handler.ErrorResponse
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// parseServerError returns the error for a non-200 response with body b.
+// Bodies that are not an ErrorResponse, e.g. from API Gateway itself, are
+// reported verbatim.
+func parseServerError(status int, retryAfter string, b []byte) error {
+	e := &serverError{Status: status, RetryAfter: retryAfter}
+	if json.Unmarshal(b, &e.ErrorResponse) != nil || e.Code == "" {
+		return fmt.Errorf("server error %d: %s", status, strings.TrimSpace(string(b)))
+	}
+	return e
+}
+
+// retryResponse reports whether a failed response may be retried.  Error
+// envelopes come from the handler, which may have redeemed the authorization
+// code before failing, so a retry would only fail with invalid_grant; the
+// exception is provider_unavailable, which it returns before.  Other
+// responses, e.g. throttling by API Gateway, never reached the handler.
+func retryResponse(resp *http.Response) bool {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	var se *serverError
+	if errors.As(parseServerError(resp.StatusCode, "", b), &se) {
+		return se.Code == handler.ErrProviderUnavailable
+	}
+	return true
+}
+
+// fatal reports err and exits with its exit code.
+func fatal(err error) {
+	var se *serverError
+	if !errors.As(err, &se) {
+		log.Fatalf("failed to get credentials: %v", err)
+	}
+	exitCode, summary := describeServerError(se.Code)
+	log.Printf("failed to get credentials: %s", summary)
+	log.Printf("  %s: %s", se.Code, se.Message)
+	if se.RequestID != "" {
+		log.Printf("  request ID: %s", se.RequestID)
+	}
+	if se.Retryable && se.RetryAfter != "" {
+		log.Printf("  retry after %s seconds", se.RetryAfter)
+	}
+	os.Exit(exitCode)
+}
+
+// describeServerError returns the exit code and summary for an error code
+// of the backend.
+func describeServerError(code string) (int, string) {
+	if desc, ok := serverErrors[code]; ok {
+		return desc.exitCode, desc.summary
+	}
+	return exitFailure, "the server failed"
+}
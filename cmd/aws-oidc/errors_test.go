@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michaelw/aws-oidc-cli/internal/handler"
+)
+
+func TestParseServerError(t *testing.T) {
+	err := parseServerError(429, "5", []byte(`{"code":"throttled","message":"rate exceeded","request_id":"req-1","retryable":true}`))
+	var se *serverError
+	require.True(t, errors.As(err, &se))
+	assert.Equal(t, &serverError{
+		Status:     429,
+		RetryAfter: "5",
+		ErrorResponse: handler.ErrorResponse{
+			Code:      handler.ErrThrottled,
+			Message:   "rate exceeded",
+			RequestID: "req-1",
+			Retryable: true,
+		},
+	}, se)
+	assert.EqualError(t, err, "rate exceeded (throttled)")
+
+	for name, body := range map[string]string{
+		"gateway JSON": `{"message":"Forbidden"}`,
+		"not JSON":     "<html>Bad Gateway</html>\n",
+		"empty":        "",
+	} {
+		err := parseServerError(403, "", []byte(body))
+		assert.False(t, errors.As(err, &se), name)
+		assert.EqualError(t, err, "server error 403: "+strings.TrimSpace(body), name)
+	}
+}
+
+func TestDescribeServerError(t *testing.T) {
+	codes := []string{
+		handler.ErrInvalidRequest, handler.ErrInvalidState, handler.ErrInvalidDPoP,
+		handler.ErrInvalidGrant, handler.ErrInvalidToken, handler.ErrClaimsRejected,
+		handler.ErrStepUpRequired, handler.ErrAccessDenied, handler.ErrIdentityRejected,
+		handler.ErrThrottled, handler.ErrIdPError, handler.ErrSTSError,
+		handler.ErrProviderUnavailable, handler.ErrNotFound, handler.ErrInternal,
+	}
+	// Exit codes are documented and must not change
+	for i, code := range codes {
+		exitCode, summary := describeServerError(code)
+		assert.Equal(t, 10+i, exitCode, code)
+		assert.NotEmpty(t, summary, code)
+	}
+	assert.Len(t, serverErrors, len(codes))
+
+	exitCode, _ := describeServerError("new_code")
+	assert.Equal(t, exitFailure, exitCode)
+}
+
+func TestRetryResponse(t *testing.T) {
+	cases := []struct {
+		name  string
+		body  string
+		retry bool
+	}{
+		{"gateway throttling", `{"message":"Too Many Requests"}`, true},
+		{"gateway error", `Internal server error`, true},
+		{"throttled by STS", `{"code":"throttled","message":"rate exceeded","retryable":true}`, false},
+		{"STS failure", `{"code":"sts_error","message":"failed","retryable":true}`, false},
+		{"provider unavailable", `{"code":"provider_unavailable","message":"discovery failed","retryable":true}`, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: 503, Body: io.NopCloser(strings.NewReader(c.body))}
+			assert.Equal(t, c.retry, retryResponse(resp))
+			b, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, c.body, string(b), "body stays readable")
+		})
+	}
+}
@@ -2,26 +2,31 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mitchellh/go-homedir"
-	"github.com/pkg/browser"
 	"golang.org/x/oauth2"
 
+	"github.com/michaelw/aws-oidc-cli/internal/dpop"
 	"github.com/michaelw/aws-oidc-cli/internal/handler"
+	"github.com/michaelw/aws-oidc-cli/internal/httpclient"
+	"github.com/michaelw/aws-oidc-cli/internal/jwe"
 )
 
 const authCompleteHTML = `
@@ -35,7 +40,7 @@ const authCompleteHTML = `
     body { font-family: sans-serif; text-align: center; margin-top: 80px; }
   </style>
   <script>
-    // Remove query parameters from the URL after successful auth
+    // Remove query parameters from the URL after auth
     if (window.history && window.history.replaceState) {
       window.history.replaceState({}, document.title, window.location.pathname);
     }
@@ -54,6 +59,23 @@ var CLI struct {
 		Role      string `help:"AWS Role ARN to assume" required:""`
 		Account   string `help:"AWS Account ID" required:""`
 		UseSecret bool   `help:"Use secret for code verifier (optional)"`
+
+		AllowPlaintext bool `help:"Accept unencrypted credentials from servers that do not support response encryption"`
+
+		SessionPolicy string   `help:"Path to a JSON session policy to down-scope the credentials" type:"existingfile"`
+		PolicyArn     []string `help:"ARN of a managed session policy to down-scope the credentials (repeatable)"`
+
+		Duration time.Duration `help:"Requested session duration, e.g. 1h or 12h (default 30m; capped by the server)"`
+
+		LoginHint  string   `help:"Account to log in as, passed to the IdP as login_hint"`
+		DomainHint string   `help:"Domain to log in with, passed to the IdP as domain_hint"`
+		Prompt     string   `help:"Prompt the IdP should show, e.g. login or select_account"`
+		AcrValues  string   `help:"Space-separated authentication context class references to request"`
+		Scope      []string `help:"Additional scope to request (repeatable)"`
+
+		CallbackPort string        `help:"Loopback port or port range, e.g. 8400-8409, for the login callback (default any free port)"`
+		LoginTimeout time.Duration `help:"How long the login may take in total, or 0 for no limit" default:"5m"`
+		Browser      string        `help:"How to open the login URL: auto (default browser), none (print it and accept the redirect URL on stdin), or a command to run with the URL"`
 	} `cmd:"process" help:"Process OIDC flow and vend AWS credentials"`
 	Config string `help:"Path to config file" default:"~/.config/aws-oidc/oidc-providers.json"`
 }
@@ -63,6 +85,60 @@ var CLI struct {
 type ProviderConfig struct {
 	Name   string `json:"name"`
 	ApiURL string `json:"api_url"`
+	// Issuer selects a named issuer on backends that serve several, unless
+	// api_url already ends in the issuer's path prefix.
+	Issuer string `json:"issuer,omitempty"`
+
+	// Defaults for the corresponding command line flags
+	LoginHint  string   `json:"login_hint,omitempty"`
+	DomainHint string   `json:"domain_hint,omitempty"`
+	Prompt     string   `json:"prompt,omitempty"`
+	ACRValues  string   `json:"acr_values,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	// CallbackPort and Browser are the defaults for --callback-port and
+	// --browser.
+	CallbackPort string `json:"callback_port,omitempty"`
+	Browser      string `json:"browser,omitempty"`
+
+	// HTTP settings for requests to api_url
+	httpclient.Config
+}
+
+// httpClient returns the client for requests to the provider's API.
+func (p *ProviderConfig) httpClient() (*httpclient.Client, error) {
+	cfg := p.Config
+	for _, path := range []*string{&cfg.CABundle, &cfg.ClientCert, &cfg.ClientKey} {
+		if *path == "" {
+			continue
+		}
+		expanded, err := homedir.Expand(*path)
+		if err != nil {
+			return nil, err
+		}
+		*path = expanded
+	}
+	c, err := httpclient.New(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.RetryIf = retryResponse
+	return c, nil
+}
+
+// authOptions returns the authorization parameters for a login, with
+// command line flags taking precedence over the provider defaults.
+func (p *ProviderConfig) authOptions() authOptions {
+	opts := authOptions{
+		LoginHint:  cmp.Or(CLI.Process.LoginHint, p.LoginHint),
+		DomainHint: cmp.Or(CLI.Process.DomainHint, p.DomainHint),
+		Prompt:     cmp.Or(CLI.Process.Prompt, p.Prompt),
+		ACRValues:  cmp.Or(CLI.Process.AcrValues, p.ACRValues),
+		Scopes:     p.Scopes,
+	}
+	if len(CLI.Process.Scope) > 0 {
+		opts.Scopes = CLI.Process.Scope
+	}
+	return opts
 }
 
 type Providers struct {
@@ -102,86 +178,198 @@ func main() {
 	if provider == nil {
 		log.Fatalf("provider '%v' not found in config", CLI.Process.Provider)
 	}
+	client, err := provider.httpClient()
+	if err != nil {
+		log.Fatalf("invalid HTTP settings for provider '%v': %v", provider.Name, err)
+	}
+
+	// Read the session policy before sending the user to the browser
+	var sessionPolicy string
+	if CLI.Process.SessionPolicy != "" {
+		b, err := os.ReadFile(CLI.Process.SessionPolicy)
+		if err != nil {
+			log.Fatalf("failed to read session policy: %v", err)
+		}
+		if !json.Valid(b) {
+			log.Fatalf("session policy %s is not valid JSON", CLI.Process.SessionPolicy)
+		}
+		sessionPolicy = string(b)
+	}
+
+	// Flow-independent part of the /creds request
+	credsReq := handler.CredsRequest{
+		Account:    CLI.Process.Account,
+		Role:       CLI.Process.Role,
+		Policy:     sessionPolicy,
+		PolicyARNs: CLI.Process.PolicyArn,
+		Duration:   int32(CLI.Process.Duration.Seconds()),
+		Provider:   provider.Issuer,
+	}
+	// Interrupts and the login timeout abort the login
+	loginCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout := CLI.Process.LoginTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		loginCtx, cancel = context.WithTimeoutCause(loginCtx, timeout, fmt.Errorf("login timed out after %s", timeout))
+		defer cancel()
+	}
+
+	opts := provider.authOptions()
+	creds, err := login(loginCtx, provider, client, credsReq, opts)
+	var stepUp *serverError
+	if errors.As(err, &stepUp) && stepUp.Code == handler.ErrStepUpRequired {
+		// The role needs stronger authentication than the IdP session has
+		log.Printf("%s; logging in again", stepUp.Message)
+		opts.ACRValues, opts.Prompt = stepUp.ACRValues, "login"
+		creds, err = login(loginCtx, provider, client, credsReq, opts)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	// Print credentials in AWS credential_process format
+	output, _ := json.MarshalIndent(creds, "", "  ")
+	fmt.Println(string(output))
+}
+
+// authOptions are optional authorization request parameters passed to /auth.
+type authOptions struct {
+	LoginHint  string
+	DomainHint string
+	Prompt     string
+	ACRValues  string
+	Scopes     []string
+}
+
+// set adds the non-empty options to params.
+func (o authOptions) set(params url.Values) {
+	for name, v := range map[string]string{
+		"login_hint":  o.LoginHint,
+		"domain_hint": o.DomainHint,
+		"prompt":      o.Prompt,
+		"acr_values":  o.ACRValues,
+		"scope":       strings.Join(o.Scopes, " "),
+	} {
+		if v != "" {
+			params.Set(name, v)
+		}
+	}
+}
 
+// login runs one browser login and exchanges the code for credentials.
+// credsReq holds the flow-independent fields of the /creds request.  The
+// login ends early if the IdP returns an error or ctx is done.
+func login(ctx context.Context, provider *ProviderConfig, client *httpclient.Client, credsReq handler.CredsRequest, opts authOptions) (*handler.CredsResponse, error) {
 	// Start local server for redirect
-	port := randomPort()
-	redirectURI := fmt.Sprintf("http://127.0.0.1:%d/creds", port)
-	server := &http.Server{Addr: ":" + strconv.Itoa(port)}
+	listener, redirectURI, err := listenCallback(cmp.Or(CLI.Process.CallbackPort, provider.CallbackPort))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
 
-	codeCh := make(chan string)
+	codeCh := make(chan callbackResult, 1)
 	state := randomState()
+	nonce := randomState()
 
-	http.HandleFunc("/creds", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("state") != state {
-			http.Error(w, "invalid state", http.StatusBadRequest)
-			return
-		}
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			http.Error(w, "missing code", http.StatusBadRequest)
-			return
-		}
-		fmt.Fprintf(w, authCompleteHTML, "Authentication complete.  You may close this window.")
-		codeCh <- code
-	})
+	mux.HandleFunc(callbackPath, callbackHandler(state, codeCh))
 
 	// Start server in background
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
 	}()
 
-	// Handle shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	defer signal.Stop(stop)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
 
 	// Begin OIDC flow (browser open, etc.)
 	challenge, verifier := generatePKCE()
+	// Ephemeral key proving possession at /creds (DPoP)
+	signer, err := dpop.NewSigner()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DPoP key: %w", err)
+	}
+	// Ephemeral key the server seals the credentials to, bound to the flow
+	var decryptionKey *ecdh.PrivateKey
+	var encryptionKey *jwe.JWK
+	if !CLI.Process.AllowPlaintext {
+		decryptionKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+		}
+		jwk := jwe.PublicJWK(decryptionKey.PublicKey())
+		encryptionKey = &jwk
+	}
 	// Construct OIDC auth URL (this would be provider-specific)
-	authURL := fmt.Sprintf("%s/auth?challenge=%s&state=%s&redirect_uri=%s", strings.TrimSuffix(provider.ApiURL, "/"), challenge, state, redirectURI)
-	fmt.Fprintf(os.Stderr, "Open the following URL in your browser to authenticate:\n  %s\n", authURL)
-	// Open the URL in the default browser
-	err = browser.OpenURL(authURL)
+	authParams := url.Values{
+		"challenge":    {challenge},
+		"state":        {state},
+		"redirect_uri": {redirectURI},
+		"nonce":        {nonce},
+		"dpop_jkt":     {signer.Thumbprint()},
+		"account":      {credsReq.Account},
+		"role":         {credsReq.Role},
+	}
+	if credsReq.Provider != "" {
+		authParams.Set("provider", credsReq.Provider)
+	}
+	opts.set(authParams)
+	if encryptionKey != nil {
+		authParams.Set("enc_jkt", encryptionKey.Thumbprint())
+	}
+	authURL := fmt.Sprintf("%s/auth?%s", strings.TrimSuffix(provider.ApiURL, "/"), authParams.Encode())
+	loginURL, signedState, err := startAuth(ctx, client, authURL)
 	if err != nil {
-		log.Fatalf("failed to open URL: %v", err)
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Open the following URL in your browser to authenticate:\n  %s\n", loginURL)
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	paste := true
+	if mode := cmp.Or(CLI.Process.Browser, provider.Browser, browserAuto); mode != browserNone {
+		// The URL is printed, so the user can still open it
+		if err := openBrowser(mode, loginURL); err != nil {
+			log.Printf("failed to open browser: %v", err)
+		} else {
+			paste = false
+		}
+	}
+	if paste {
+		fmt.Fprintln(os.Stderr, "If the browser cannot reach this machine, paste the URL it was redirected to after login, or the code from it:")
+		go readPastedCallback(waitCtx, state, signedState, codeCh)
 	}
 
-	// Wait for code or interrupt
-	var code string
+	// Wait for code, IdP error, interrupt or timeout
+	var callback callbackResult
 	select {
-	case code = <-codeCh:
-		// got code
-	case <-stop:
-		log.Println("Interrupted")
-		os.Exit(1)
+	case callback = <-codeCh:
+	case <-waitCtx.Done():
+		if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		return nil, errors.New("interrupted")
+	}
+	if callback.Err != nil {
+		return nil, callback.Err
 	}
 
 	log.Println("Login successful!")
 
-	// Shutdown server
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	_ = server.Shutdown(ctxTimeout)
-
 	// Exchange code for credentials
-	creds, err := exchangeCodeForCreds(provider.ApiURL, code, verifier, CLI.Process.Account, CLI.Process.Role, redirectURI)
-	if err != nil {
-		log.Fatalf("failed to get credentials: %v", err)
-	}
-
-	// Print credentials in AWS credential_process format
-	output, _ := json.MarshalIndent(creds, "", "  ")
-	fmt.Println(string(output))
-}
-
-// randomPort returns a random port between 49152–65535
-func randomPort() int {
-	return 49152 + int(time.Now().UnixNano()%int64(65535-49152))
+	credsReq.Code = callback.Code
+	credsReq.Verifier = verifier
+	credsReq.RedirectURI = redirectURI
+	credsReq.State = callback.State
+	credsReq.EncryptionKey = encryptionKey
+	return exchangeCodeForCreds(ctx, client, provider.ApiURL, credsReq, signer, decryptionKey)
 }
 
-// randomState returns a random string for OIDC state
+// randomState returns a random string for OIDC state (also used for the nonce)
 func randomState() string {
 	b := make([]byte, 16)
 	_, _ = rand.Read(b)
@@ -195,34 +383,71 @@ func generatePKCE() (challenge, verifier string) {
 	return
 }
 
-// exchangeCodeForCreds calls the /creds endpoint and returns credentials
-func exchangeCodeForCreds(apiURL, code, verifier, account, role, redirectURI string) (*handler.CredsResponse, error) {
-	// Compose request body
-	body := map[string]string{
-		"code":         code,
-		"verifier":     verifier,
-		"account":      account,
-		"role":         role,
-		"redirect_uri": redirectURI,
+// startAuth requests authURL, the backend's /auth, and returns the IdP URL it
+// redirects to, along with the signed state envelope if the backend reports
+// it.  Opening the IdP URL directly lets errors from /auth surface here.
+func startAuth(ctx context.Context, client *httpclient.Client, authURL string) (loginURL, signedState string, err error) {
+	resp, err := client.Do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, authURL, nil)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to GET /auth: %w", err)
+	}
+	defer resp.Body.Close()
+	loginURL = resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || loginURL == "" {
+		b, _ := io.ReadAll(resp.Body)
+		return "", "", parseServerError(resp.StatusCode, resp.Header.Get("Retry-After"), b)
 	}
+	return loginURL, resp.Header.Get(handler.StateHeader), nil
+}
+
+// exchangeCodeForCreds calls the /creds endpoint and returns credentials.
+// Unless decryptionKey is nil, the response must be sealed to it.  Failures
+// before the request reaches the handler are retried by the client; errors
+// from the handler are not, since it may already have redeemed the code.
+func exchangeCodeForCreds(ctx context.Context, client *httpclient.Client, apiURL string, body handler.CredsRequest, signer *dpop.Signer, decryptionKey *ecdh.PrivateKey) (*handler.CredsResponse, error) {
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	credsURL := fmt.Sprintf("%s/creds", apiURL)
-	resp, err := http.Post(credsURL, "application/json", bytes.NewReader(jsonBody))
+	credsURL := fmt.Sprintf("%s/creds", strings.TrimSuffix(apiURL, "/"))
+	resp, err := client.Do(ctx, func(ctx context.Context) (*http.Request, error) {
+		// DPoP proofs are single-use, so each attempt gets its own
+		proof, err := signer.Proof(http.MethodPost, credsURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign DPoP proof: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, credsURL, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create /creds request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(dpop.HeaderName, proof)
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to POST to /creds: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("/creds error: %s", string(b))
+		return nil, parseServerError(resp.StatusCode, resp.Header.Get("Retry-After"), b)
+	}
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /creds response: %w", err)
+	}
+	if decryptionKey != nil {
+		if payload, err = jwe.Decrypt(string(payload), decryptionKey); err != nil {
+			return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+		}
 	}
 
 	var creds handler.CredsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+	if err := json.Unmarshal(payload, &creds); err != nil {
 		return nil, fmt.Errorf("failed to decode credentials: %w", err)
 	}
 	creds.Expiration = creds.Expiration.Local()
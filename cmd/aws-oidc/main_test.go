@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michaelw/aws-oidc-cli/internal/dpop"
+	"github.com/michaelw/aws-oidc-cli/internal/handler"
+)
+
+func TestExchangeCodeForCreds_NoRetryAfterHandlerError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts > 1 {
+			// What a retry gets once the code has been redeemed
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(handler.ErrorResponse{Code: handler.ErrInvalidGrant, Message: "code already used"})
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(handler.ErrorResponse{Code: handler.ErrThrottled, Message: "failed to assume role: Rate exceeded", Retryable: true})
+	}))
+	defer srv.Close()
+
+	provider := &ProviderConfig{ApiURL: srv.URL}
+	client, err := provider.httpClient()
+	require.NoError(t, err)
+	signer, err := dpop.NewSigner()
+	require.NoError(t, err)
+
+	_, err = exchangeCodeForCreds(context.Background(), client, srv.URL, handler.CredsRequest{Code: "c"}, signer, nil)
+	var se *serverError
+	require.True(t, errors.As(err, &se), "%v", err)
+	assert.Equal(t, handler.ErrThrottled, se.Code)
+	assert.Equal(t, "5", se.RetryAfter)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestStartAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("prompt") == "bogus" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(handler.ErrorResponse{Code: handler.ErrInvalidRequest, Message: "prompt not allowed"})
+			return
+		}
+		w.Header().Set(handler.StateHeader, "signed-state")
+		http.Redirect(w, r, "https://idp.example.com/authorize?client_id=c", http.StatusFound)
+	}))
+	defer srv.Close()
+	provider := &ProviderConfig{ApiURL: srv.URL}
+	client, err := provider.httpClient()
+	require.NoError(t, err)
+
+	loginURL, signedState, err := startAuth(context.Background(), client, srv.URL+"/auth?state=s")
+	require.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com/authorize?client_id=c", loginURL)
+	assert.Equal(t, "signed-state", signedState)
+
+	_, _, err = startAuth(context.Background(), client, srv.URL+"/auth?prompt=bogus")
+	var se *serverError
+	require.True(t, errors.As(err, &se), "%v", err)
+	assert.Equal(t, handler.ErrInvalidRequest, se.Code)
+}
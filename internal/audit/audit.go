@@ -0,0 +1,198 @@
+// Package audit records credential issuance decisions as structured JSON
+// events and delivers them to pluggable sinks.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies audit events in mixed log streams.
+const EventType = "aws-oidc.credentials"
+
+const (
+	OutcomeIssued = "issued"
+	OutcomeDenied = "denied"
+)
+
+// Event describes one /creds request.  It never carries secrets: no codes,
+// verifiers, tokens, secret access keys or session tokens.
+type Event struct {
+	Type              string    `json:"type"`
+	Time              time.Time `json:"time"`
+	Outcome           string    `json:"outcome"`
+	Status            int       `json:"status"`
+	Reason            string    `json:"reason,omitempty"`
+	RequestID         string    `json:"request_id,omitempty"`
+	SourceIP          string    `json:"source_ip,omitempty"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	Caller            string    `json:"caller,omitempty"`
+	APIKeyID          string    `json:"api_key_id,omitempty"`
+	Provider          string    `json:"provider,omitempty"`
+	Issuer            string    `json:"issuer,omitempty"`
+	Subject           string    `json:"subject,omitempty"`
+	Email             string    `json:"email,omitempty"`
+	Account           string    `json:"account,omitempty"`
+	Role              string    `json:"role,omitempty"`
+	SessionName       string    `json:"session_name,omitempty"`
+	SourceIdentity    string    `json:"source_identity,omitempty"`
+	RequestedDuration int32     `json:"requested_duration_seconds,omitempty"`
+	GrantedDuration   int32     `json:"granted_duration_seconds,omitempty"`
+	SessionPolicy     bool      `json:"session_policy,omitempty"`
+	PolicyARNs        []string  `json:"policy_arns,omitempty"`
+	AccessKeyID       string    `json:"access_key_id,omitempty"`
+	// SessionTags are the tags applied to the session.
+	SessionTags map[string]string `json:"session_tags,omitempty"`
+}
+
+// Sink receives audit events.
+type Sink interface {
+	Emit(ctx context.Context, ev Event) error
+}
+
+// SinkFunc adapts a function to Sink.
+type SinkFunc func(ctx context.Context, ev Event) error
+
+func (f SinkFunc) Emit(ctx context.Context, ev Event) error {
+	return f(ctx, ev)
+}
+
+// secretPatterns match credentials that may leak into free-text fields such
+// as error messages from STS or the IdP.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),                         // JWTs
+	regexp.MustCompile(`(?i)(secret|token|code|verifier|password)(["']?\s*[:=]\s*["']?)[^\s"',&]+`), // key=value secrets
+}
+
+// Redact scrubs secrets from s.
+func Redact(s string) string {
+	s = secretPatterns[0].ReplaceAllString(s, "[REDACTED]")
+	return secretPatterns[1].ReplaceAllString(s, "${1}${2}[REDACTED]")
+}
+
+// prepare fills defaults and redacts free-text fields.
+func prepare(ev Event) Event {
+	ev.Type = EventType
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	ev.Reason = Redact(ev.Reason)
+	return ev
+}
+
+// writerSink writes one JSON object per line.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink writing JSON lines to w.  On Lambda, a sink on
+// os.Stdout delivers events to CloudWatch Logs.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Emit(ctx context.Context, ev Event) error {
+	b, err := json.Marshal(prepare(ev))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// NewFileSink returns a sink appending JSON lines to the file at path.
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(f), nil
+}
+
+// webhookSink POSTs each event as JSON.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting events to url.
+func NewWebhookSink(url string, client *http.Client) Sink {
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+	return &webhookSink{url: url, client: client}
+}
+
+func (s *webhookSink) Emit(ctx context.Context, ev Event) error {
+	b, err := json.Marshal(prepare(ev))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// multiSink fans events out to several sinks.
+type multiSink []Sink
+
+func (m multiSink) Emit(ctx context.Context, ev Event) error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Emit(ctx, ev))
+	}
+	return errors.Join(errs...)
+}
+
+// ParseSinks builds a sink from specs of the form "stdout", "file:<path>" or
+// an http(s) webhook URL.  No specs means stdout.
+func ParseSinks(specs []string) (Sink, error) {
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+	var sinks multiSink
+	for _, spec := range specs {
+		switch {
+		case spec == "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		case strings.HasPrefix(spec, "file:"):
+			s, err := NewFileSink(strings.TrimPrefix(spec, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case strings.HasPrefix(spec, "https://"), strings.HasPrefix(spec, "http://"):
+			sinks = append(sinks, NewWebhookSink(spec, nil))
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", spec)
+		}
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
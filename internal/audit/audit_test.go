@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewWriterSink(&buf)
+	require.NoError(t, s.Emit(context.Background(), Event{Outcome: OutcomeIssued, Email: "foo@bar.com"}))
+	require.NoError(t, s.Emit(context.Background(), Event{Outcome: OutcomeDenied}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var ev Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, EventType, ev.Type)
+	assert.Equal(t, OutcomeIssued, ev.Outcome)
+	assert.Equal(t, "foo@bar.com", ev.Email)
+	assert.False(t, ev.Time.IsZero())
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Emit(context.Background(), Event{Outcome: OutcomeIssued}))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"outcome":"issued"`)
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(b, &got)
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewWebhookSink(srv.URL, nil).Emit(context.Background(), Event{Outcome: OutcomeDenied, Reason: "nope"}))
+	assert.Equal(t, OutcomeDenied, got.Outcome)
+	assert.Equal(t, "nope", got.Reason)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.Error(t, NewWebhookSink(failing.URL, nil).Emit(context.Background(), Event{}))
+}
+
+func TestRedact(t *testing.T) {
+	jwt := "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln"
+	cases := map[string]string{
+		"invalid id_token " + jwt:      "invalid id_token [REDACTED]",
+		"SessionToken=abc123 and more": "SessionToken=[REDACTED] and more",
+		`{"client_secret": "hunter2"}`: `{"client_secret": "[REDACTED]"}`,
+		"AccessDenied: not authorized": "AccessDenied: not authorized",
+		"code=xyz&state=s":             "code=[REDACTED]&state=s",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, Redact(in), in)
+	}
+}
+
+func TestEmitRedactsReason(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewWriterSink(&buf).Emit(context.Background(), Event{Reason: "token=secretvalue"}))
+	assert.NotContains(t, buf.String(), "secretvalue")
+}
+
+func TestParseSinks(t *testing.T) {
+	s, err := ParseSinks(nil)
+	require.NoError(t, err)
+	assert.IsType(t, &writerSink{}, s)
+
+	s, err = ParseSinks([]string{"stdout", "file:" + filepath.Join(t.TempDir(), "a.log"), "https://example.com/hook"})
+	require.NoError(t, err)
+	assert.Len(t, s, 3)
+
+	_, err = ParseSinks([]string{"syslog"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package awsutils
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// FakeSTS is a minimal STS query API for tests.  It serves
+// AssumeRoleWithWebIdentity and AssumeRole, and issues credentials whose
+// access key ID names the action and role session.
+type FakeSTS struct {
+	*httptest.Server
+
+	// MaxSessionDuration, if set, rejects longer DurationSeconds with the
+	// ValidationError STS returns for roles with a lower limit.
+	MaxSessionDuration int32
+
+	mu       sync.Mutex
+	requests []FakeSTSRequest
+}
+
+// FakeSTSRequest is a request received by FakeSTS.
+type FakeSTSRequest struct {
+	Params url.Values
+	// AccessKeyID is the access key that signed the request, if any.
+	AccessKeyID string
+	// SessionToken is the X-Amz-Security-Token of the request, if any.
+	SessionToken string
+}
+
+// NewFakeSTS starts a FakeSTS.  Callers must Close it.
+func NewFakeSTS() *FakeSTS {
+	f := &FakeSTS{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Client returns an STSClient talking to the fake, signing requests with
+// static dummy credentials.
+func (f *FakeSTS) Client() STSClient {
+	ambient := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKIDAMBIENT", SecretAccessKey: "secret"}, nil
+	})
+	return newSTSClient(aws.Config{Region: "us-east-1", Credentials: ambient}, func(o *sts.Options) {
+		o.BaseEndpoint = aws.String(f.URL)
+		o.RetryMaxAttempts = 1
+	})
+}
+
+// Requests returns the requests received so far.
+func (f *FakeSTS) Requests() []FakeSTSRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeSTSRequest(nil), f.requests...)
+}
+
+var signingAccessKey = regexp.MustCompile(`Credential=([^/]+)/`)
+
+type fakeSTSResult struct {
+	Credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	SourceIdentity string `xml:",omitempty"`
+}
+
+type fakeSTSError struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Error   struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	RequestId string
+}
+
+func (f *FakeSTS) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := FakeSTSRequest{Params: r.PostForm, SessionToken: r.Header.Get("X-Amz-Security-Token")}
+	if m := signingAccessKey.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		req.AccessKeyID = m[1]
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+
+	action := r.PostForm.Get("Action")
+	if action != "AssumeRoleWithWebIdentity" && action != "AssumeRole" {
+		writeFakeSTSError(w, "InvalidAction", "unsupported action "+action)
+		return
+	}
+	duration, _ := strconv.Atoi(r.PostForm.Get("DurationSeconds"))
+	if f.MaxSessionDuration != 0 && int32(duration) > f.MaxSessionDuration {
+		writeFakeSTSError(w, "ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.")
+		return
+	}
+
+	var result fakeSTSResult
+	result.Credentials.AccessKeyId = fmt.Sprintf("ASIA-%s-%s", action, r.PostForm.Get("RoleSessionName"))
+	result.Credentials.SecretAccessKey = "fake-secret"
+	result.Credentials.SessionToken = "fake-token-" + action
+	result.Credentials.Expiration = time.Now().Add(time.Duration(duration) * time.Second).UTC().Format(time.RFC3339)
+	result.SourceIdentity = r.PostForm.Get("SourceIdentity")
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<%sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">`, action)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name
+		fakeSTSResult
+	}{xml.Name{Local: action + "Result"}, result})
+	fmt.Fprintf(w, `<ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></%sResponse>`, action)
+}
+
+func writeFakeSTSError(w http.ResponseWriter, code, message string) {
+	var e fakeSTSError
+	e.Error.Type = "Sender"
+	e.Error.Code = code
+	e.Error.Message = message
+	e.RequestId = "fake"
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = xml.NewEncoder(w).Encode(e)
+}
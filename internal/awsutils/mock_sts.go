@@ -2,17 +2,33 @@ package awsutils
 
 import (
 	"context"
-	"time"
 )
 
 // MockSTSClient is a mock implementation of STSClient for testing.
 type MockSTSClient struct {
-	AssumeRoleWithWebIdentityFunc func(ctx context.Context, roleArn, roleSessionName, webIdentityToken string, durationSeconds int32) (string, string, string, *time.Time, error)
+	AssumeRoleWithWebIdentityFunc func(ctx context.Context, in *WebIdentityInput) (*Credentials, error)
+	AssumeRoleFunc                func(ctx context.Context, in *AssumeRoleInput) (*Credentials, error)
 }
 
-func (m *MockSTSClient) AssumeRoleWithWebIdentity(ctx context.Context, roleArn, roleSessionName, webIdentityToken string, durationSeconds int32) (string, string, string, *time.Time, error) {
+func (m *MockSTSClient) AssumeRoleWithWebIdentity(ctx context.Context, in *WebIdentityInput) (*Credentials, error) {
 	if m.AssumeRoleWithWebIdentityFunc != nil {
-		return m.AssumeRoleWithWebIdentityFunc(ctx, roleArn, roleSessionName, webIdentityToken, durationSeconds)
+		return m.AssumeRoleWithWebIdentityFunc(ctx, in)
 	}
-	return "mockAccessKey", "mockSecretKey", "mockSessionToken", nil, nil
+	return &Credentials{
+		AccessKeyID:     "mockAccessKey",
+		SecretAccessKey: "mockSecretKey",
+		SessionToken:    "mockSessionToken",
+	}, nil
+}
+
+func (m *MockSTSClient) AssumeRole(ctx context.Context, in *AssumeRoleInput) (*Credentials, error) {
+	if m.AssumeRoleFunc != nil {
+		return m.AssumeRoleFunc(ctx, in)
+	}
+	return &Credentials{
+		AccessKeyID:     "mockChainedAccessKey",
+		SecretAccessKey: "mockChainedSecretKey",
+		SessionToken:    "mockChainedSessionToken",
+		SourceIdentity:  in.SourceIdentity,
+	}, nil
 }
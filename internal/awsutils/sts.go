@@ -2,16 +2,68 @@ package awsutils
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
 )
 
 // STSClient defines the interface for AWS STS operations.
 type STSClient interface {
-	AssumeRoleWithWebIdentity(ctx context.Context, roleArn, roleSessionName, webIdentityToken string, durationSeconds int32) (accessKeyID, secretAccessKey, sessionToken string, expiration *time.Time, err error)
+	AssumeRoleWithWebIdentity(ctx context.Context, in *WebIdentityInput) (*Credentials, error)
+	AssumeRole(ctx context.Context, in *AssumeRoleInput) (*Credentials, error)
+}
+
+// WebIdentityInput holds the parameters for AssumeRoleWithWebIdentity.
+//
+// There is no SourceIdentity parameter: STS takes the source identity from
+// the token's https://aws.amazon.com/source_identity claim.
+type WebIdentityInput struct {
+	RoleArn          string
+	RoleSessionName  string
+	WebIdentityToken string
+	DurationSeconds  int32
+	// Policy and PolicyARNs are optional session policies.
+	Policy     string
+	PolicyARNs []string
+}
+
+// AssumeRoleInput holds the parameters for AssumeRole.
+type AssumeRoleInput struct {
+	// Credentials sign the request, e.g. those of a hub role session.
+	Credentials     *Credentials
+	RoleArn         string
+	RoleSessionName string
+	DurationSeconds int32
+	// Policy and PolicyARNs are optional session policies.
+	Policy     string
+	PolicyARNs []string
+	// SourceIdentity, Tags, TransitiveTagKeys and ExternalID are optional.
+	SourceIdentity    string
+	Tags              []Tag
+	TransitiveTagKeys []string
+	ExternalID        string
+}
+
+// Tag is an STS session tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Credentials are temporary credentials returned by STS.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+	// SourceIdentity is the source identity STS applied to the session, if any.
+	SourceIdentity string
 }
 
 // stsClient implements STSClient using AWS SDK v2.
@@ -24,18 +76,93 @@ func NewSTSClient(ctx context.Context) (STSClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &stsClient{Client: sts.NewFromConfig(cfg)}, nil
+	return newSTSClient(cfg), nil
+}
+
+func newSTSClient(cfg aws.Config, optFns ...func(*sts.Options)) STSClient {
+	return &stsClient{Client: sts.NewFromConfig(cfg, optFns...)}
 }
 
-func (r *stsClient) AssumeRoleWithWebIdentity(ctx context.Context, roleArn, roleSessionName, webIdentityToken string, durationSeconds int32) (string, string, string, *time.Time, error) {
+func (r *stsClient) AssumeRoleWithWebIdentity(ctx context.Context, in *WebIdentityInput) (*Credentials, error) {
 	out, err := r.Client.AssumeRoleWithWebIdentity(ctx, &sts.AssumeRoleWithWebIdentityInput{
-		RoleArn:          aws.String(roleArn),
-		RoleSessionName:  aws.String(roleSessionName),
-		WebIdentityToken: aws.String(webIdentityToken),
-		DurationSeconds:  aws.Int32(durationSeconds),
+		RoleArn:          aws.String(in.RoleArn),
+		RoleSessionName:  aws.String(in.RoleSessionName),
+		WebIdentityToken: aws.String(in.WebIdentityToken),
+		DurationSeconds:  aws.Int32(in.DurationSeconds),
+		Policy:           optionalString(in.Policy),
+		PolicyArns:       policyDescriptors(in.PolicyARNs),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Expiration:      out.Credentials.Expiration,
+		SourceIdentity:  aws.ToString(out.SourceIdentity),
+	}, nil
+}
+
+func (r *stsClient) AssumeRole(ctx context.Context, in *AssumeRoleInput) (*Credentials, error) {
+	var tags []types.Tag
+	for _, t := range in.Tags {
+		tags = append(tags, types.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)})
+	}
+	out, err := r.Client.AssumeRole(ctx, &sts.AssumeRoleInput{
+		RoleArn:           aws.String(in.RoleArn),
+		RoleSessionName:   aws.String(in.RoleSessionName),
+		DurationSeconds:   aws.Int32(in.DurationSeconds),
+		Policy:            optionalString(in.Policy),
+		PolicyArns:        policyDescriptors(in.PolicyARNs),
+		SourceIdentity:    optionalString(in.SourceIdentity),
+		Tags:              tags,
+		TransitiveTagKeys: in.TransitiveTagKeys,
+		ExternalId:        optionalString(in.ExternalID),
+	}, func(o *sts.Options) {
+		if c := in.Credentials; c != nil {
+			o.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+				return aws.Credentials{
+					AccessKeyID:     c.AccessKeyID,
+					SecretAccessKey: c.SecretAccessKey,
+					SessionToken:    c.SessionToken,
+				}, nil
+			})
+		}
 	})
 	if err != nil {
-		return "", "", "", nil, err
+		return nil, err
+	}
+	return &Credentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Expiration:      out.Credentials.Expiration,
+		SourceIdentity:  aws.ToString(out.SourceIdentity),
+	}, nil
+}
+
+// IsMaxSessionDurationError reports whether err is the STS ValidationError
+// for a DurationSeconds that exceeds the role's MaxSessionDuration.
+func IsMaxSessionDurationError(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) &&
+		apiErr.ErrorCode() == "ValidationError" &&
+		strings.Contains(apiErr.ErrorMessage(), "MaxSessionDuration")
+}
+
+// optionalString returns nil for empty strings, so they are omitted from requests.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func policyDescriptors(arns []string) []types.PolicyDescriptorType {
+	var out []types.PolicyDescriptorType
+	for _, arn := range arns {
+		out = append(out, types.PolicyDescriptorType{Arn: aws.String(arn)})
 	}
-	return aws.ToString(out.Credentials.AccessKeyId), aws.ToString(out.Credentials.SecretAccessKey), aws.ToString(out.Credentials.SessionToken), out.Credentials.Expiration, nil
+	return out
 }
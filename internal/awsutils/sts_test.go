@@ -2,16 +2,109 @@ package awsutils
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMockSTSClient(t *testing.T) {
 	var stsClient STSClient = &MockSTSClient{}
-	ak, sk, st, _, err := stsClient.AssumeRoleWithWebIdentity(context.Background(), "arn", "sess", "token", 900)
+	creds, err := stsClient.AssumeRoleWithWebIdentity(context.Background(), &WebIdentityInput{
+		RoleArn:          "arn",
+		RoleSessionName:  "sess",
+		WebIdentityToken: "token",
+		DurationSeconds:  900,
+	})
 	assert.NoError(t, err)
-	assert.Equal(t, "mockAccessKey", ak)
-	assert.Equal(t, "mockSecretKey", sk)
-	assert.Equal(t, "mockSessionToken", st)
+	assert.Equal(t, "mockAccessKey", creds.AccessKeyID)
+	assert.Equal(t, "mockSecretKey", creds.SecretAccessKey)
+	assert.Equal(t, "mockSessionToken", creds.SessionToken)
+}
+
+func TestIsMaxSessionDurationError(t *testing.T) {
+	tooLong := &smithy.GenericAPIError{
+		Code:    "ValidationError",
+		Message: "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.",
+	}
+	assert.True(t, IsMaxSessionDurationError(tooLong))
+	assert.True(t, IsMaxSessionDurationError(fmt.Errorf("operation error STS: %w", tooLong)))
+	assert.False(t, IsMaxSessionDurationError(&smithy.GenericAPIError{Code: "ValidationError", Message: "1 validation error detected"}))
+	assert.False(t, IsMaxSessionDurationError(&smithy.GenericAPIError{Code: "AccessDenied", Message: "MaxSessionDuration"}))
+	assert.False(t, IsMaxSessionDurationError(errors.New("MaxSessionDuration")))
+	assert.False(t, IsMaxSessionDurationError(nil))
+}
+
+func TestSTSClient_AssumeRoleWithWebIdentity(t *testing.T) {
+	fake := NewFakeSTS()
+	defer fake.Close()
+
+	creds, err := fake.Client().AssumeRoleWithWebIdentity(context.Background(), &WebIdentityInput{
+		RoleArn:          "arn:aws:iam::123456789012:role/hub",
+		RoleSessionName:  "alice",
+		WebIdentityToken: "token",
+		DurationSeconds:  900,
+		Policy:           `{"Version":"2012-10-17"}`,
+		PolicyARNs:       []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA-AssumeRoleWithWebIdentity-alice", creds.AccessKeyID)
+	assert.Equal(t, "fake-token-AssumeRoleWithWebIdentity", creds.SessionToken)
+	require.NotNil(t, creds.Expiration)
+
+	reqs := fake.Requests()
+	require.Len(t, reqs, 1)
+	p := reqs[0].Params
+	assert.Equal(t, "token", p.Get("WebIdentityToken"))
+	assert.Equal(t, "900", p.Get("DurationSeconds"))
+	assert.Equal(t, `{"Version":"2012-10-17"}`, p.Get("Policy"))
+	assert.Equal(t, "arn:aws:iam::aws:policy/ReadOnlyAccess", p.Get("PolicyArns.member.1.arn"))
+	assert.False(t, p.Has("SourceIdentity"))
+}
+
+func TestSTSClient_AssumeRole(t *testing.T) {
+	fake := NewFakeSTS()
+	defer fake.Close()
+
+	creds, err := fake.Client().AssumeRole(context.Background(), &AssumeRoleInput{
+		Credentials:     &Credentials{AccessKeyID: "ASIAHUB", SecretAccessKey: "hub-secret", SessionToken: "hub-token"},
+		RoleArn:         "arn:aws:iam::210987654321:role/target",
+		RoleSessionName: "alice",
+		DurationSeconds: 3600,
+		SourceIdentity:  "alice@example.com",
+		Tags:            []Tag{{Key: "Team", Value: "platform"}},
+		ExternalID:      "ext",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA-AssumeRole-alice", creds.AccessKeyID)
+	assert.Equal(t, "alice@example.com", creds.SourceIdentity)
+
+	reqs := fake.Requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "ASIAHUB", reqs[0].AccessKeyID, "signed with the hub session")
+	assert.Equal(t, "hub-token", reqs[0].SessionToken)
+	p := reqs[0].Params
+	assert.Equal(t, "arn:aws:iam::210987654321:role/target", p.Get("RoleArn"))
+	assert.Equal(t, "alice@example.com", p.Get("SourceIdentity"))
+	assert.Equal(t, "Team", p.Get("Tags.member.1.Key"))
+	assert.Equal(t, "platform", p.Get("Tags.member.1.Value"))
+	assert.Equal(t, "ext", p.Get("ExternalId"))
+	assert.False(t, p.Has("Policy"))
+}
+
+func TestSTSClient_MaxSessionDuration(t *testing.T) {
+	fake := NewFakeSTS()
+	defer fake.Close()
+	fake.MaxSessionDuration = 3600
+
+	_, err := fake.Client().AssumeRoleWithWebIdentity(context.Background(), &WebIdentityInput{
+		RoleArn:          "arn:aws:iam::123456789012:role/r",
+		RoleSessionName:  "alice",
+		WebIdentityToken: "token",
+		DurationSeconds:  7200,
+	})
+	assert.True(t, IsMaxSessionDurationError(err), "%v", err)
 }
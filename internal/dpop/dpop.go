@@ -0,0 +1,179 @@
+// Package dpop implements the subset of OAuth 2.0 Demonstrating
+// Proof-of-Possession (RFC 9449) used between the CLI and the /creds endpoint:
+// the CLI signs a proof over each request with an ephemeral P-256 key, and
+// the server checks it against the key thumbprint bound at /auth.
+package dpop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/michaelw/aws-oidc-cli/internal/jwk"
+)
+
+// HeaderName is the HTTP header carrying the proof.
+const HeaderName = "DPoP"
+
+// proofType is the required "typ" header of a proof JWT.
+const proofType = "dpop+jwt"
+
+// MaxAge is how old (or how far in the future) a proof's iat may be.
+const MaxAge = 5 * time.Minute
+
+var ErrInvalidProof = errors.New("invalid DPoP proof")
+
+// JWK is the public key of a proof, as an EC P-256 JSON Web Key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (k JWK) Thumbprint() string {
+	return jwk.Thumbprint(map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X, "y": k.Y})
+}
+
+func (k JWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s/%s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != 32 {
+		return nil, errors.New("malformed x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(y) != 32 {
+		return nil, errors.New("malformed y coordinate")
+	}
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+}
+
+// Signer holds an ephemeral key pair and signs proofs with it.
+type Signer struct {
+	key *ecdsa.PrivateKey
+	jwk JWK
+}
+
+// NewSigner generates a fresh P-256 key pair.
+func NewSigner() (*Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		key: key,
+		jwk: JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(pub[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(pub[33:]),
+		},
+	}, nil
+}
+
+// Thumbprint returns the thumbprint of the signer's public key.
+func (s *Signer) Thumbprint() string {
+	return s.jwk.Thumbprint()
+}
+
+// proofClaims are the claims of a DPoP proof JWT.
+type proofClaims struct {
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	jwt.RegisteredClaims
+}
+
+// Proof returns a proof JWT for a request with the given method and URL.
+func (s *Signer) Proof(method, uri string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, proofClaims{
+		HTM: method,
+		HTU: uri,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       base64.RawURLEncoding.EncodeToString(jti),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	})
+	tok.Header["typ"] = proofType
+	tok.Header["jwk"] = s.jwk
+	return tok.SignedString(s.key)
+}
+
+// Verify checks a proof for a request with the given method and URL, and
+// returns the thumbprint of the key that signed it.  Callers compare the
+// thumbprint with the one bound to the flow.
+//
+// Replay of a proof (jti) is not tracked; proofs are only accepted together
+// with a single-use authorization code.
+func Verify(proof, method, uri string) (string, error) {
+	var jwk JWK
+	claims := &proofClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(tok *jwt.Token) (any, error) {
+		if typ, _ := tok.Header["typ"].(string); typ != proofType {
+			return nil, errors.New("wrong typ")
+		}
+		raw, err := json.Marshal(tok.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, err
+		}
+		return jwk.publicKey()
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(MaxAge),
+	)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	if claims.ID == "" {
+		return "", fmt.Errorf("%w: missing jti", ErrInvalidProof)
+	}
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > MaxAge {
+		return "", fmt.Errorf("%w: stale or missing iat", ErrInvalidProof)
+	}
+	if claims.HTM != method {
+		return "", fmt.Errorf("%w: htm mismatch", ErrInvalidProof)
+	}
+	if !sameURI(claims.HTU, uri) {
+		return "", fmt.Errorf("%w: htu mismatch", ErrInvalidProof)
+	}
+	return jwk.Thumbprint(), nil
+}
+
+// sameURI compares two URIs ignoring query, fragment and the case of scheme
+// and host (RFC 9449, section 4.3).
+func sameURI(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) &&
+		strings.EqualFold(ua.Host, ub.Host) &&
+		ua.EscapedPath() == ub.EscapedPath()
+}
@@ -0,0 +1,90 @@
+package dpop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testURI = "https://api.example.com/Prod/creds"
+
+func TestProofRoundTrip(t *testing.T) {
+	s, err := NewSigner()
+	require.NoError(t, err)
+	proof, err := s.Proof("POST", testURI)
+	require.NoError(t, err)
+
+	jkt, err := Verify(proof, "POST", testURI)
+	require.NoError(t, err)
+	assert.Equal(t, s.Thumbprint(), jkt)
+
+	// Scheme and host are compared case-insensitively, query is ignored.
+	_, err = Verify(proof, "POST", "HTTPS://API.example.com/Prod/creds?x=1")
+	assert.NoError(t, err)
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 7638 requires members in lexicographic order; check the encoding is stable.
+	k := JWK{Kty: "EC", Crv: "P-256", X: "x", Y: "y"}
+	assert.Equal(t, k.Thumbprint(), JWK{Crv: "P-256", Kty: "EC", X: "x", Y: "y"}.Thumbprint())
+	assert.NotEqual(t, k.Thumbprint(), JWK{Kty: "EC", Crv: "P-256", X: "x", Y: "z"}.Thumbprint())
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	s, err := NewSigner()
+	require.NoError(t, err)
+
+	sign := func(header map[string]any, claims proofClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		for k, v := range header {
+			tok.Header[k] = v
+		}
+		out, err := tok.SignedString(s.key)
+		require.NoError(t, err)
+		return out
+	}
+	valid := proofClaims{HTM: "POST", HTU: testURI, RegisteredClaims: jwt.RegisteredClaims{
+		ID:       "id",
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}}
+	stale := valid
+	stale.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * MaxAge))
+	future := valid
+	future.IssuedAt = jwt.NewNumericDate(time.Now().Add(2 * MaxAge))
+	noJTI := valid
+	noJTI.ID = ""
+	other, err := NewSigner()
+	require.NoError(t, err)
+
+	good, err := s.Proof("POST", testURI)
+	require.NoError(t, err)
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte("k"))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		proof  string
+		method string
+		uri    string
+	}{
+		"wrong method":  {good, "GET", testURI},
+		"wrong uri":     {good, "POST", "https://api.example.com/Prod/auth"},
+		"wrong host":    {good, "POST", "https://evil.example.com/Prod/creds"},
+		"missing typ":   {sign(map[string]any{"jwk": s.jwk}, valid), "POST", testURI},
+		"missing jwk":   {sign(map[string]any{"typ": proofType}, valid), "POST", testURI},
+		"other key":     {sign(map[string]any{"typ": proofType, "jwk": other.jwk}, valid), "POST", testURI},
+		"stale":         {sign(map[string]any{"typ": proofType, "jwk": s.jwk}, stale), "POST", testURI},
+		"future":        {sign(map[string]any{"typ": proofType, "jwk": s.jwk}, future), "POST", testURI},
+		"missing jti":   {sign(map[string]any{"typ": proofType, "jwk": s.jwk}, noJTI), "POST", testURI},
+		"symmetric alg": {hmac, "POST", testURI},
+		"not a jwt":     {"garbage", "POST", testURI},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Verify(c.proof, c.method, c.uri)
+			assert.ErrorIs(t, err, ErrInvalidProof)
+		})
+	}
+}
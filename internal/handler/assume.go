@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+)
+
+// maxChainedSessionDuration is the STS limit for sessions obtained by role
+// chaining.
+const maxChainedSessionDuration = time.Hour
+
+// sessionRequest describes the session to obtain for the target role.
+type sessionRequest struct {
+	RoleArn        string
+	SessionName    string
+	Duration       time.Duration
+	Policies       sessionPolicies
+	SourceIdentity string
+	Tags           []awsutils.Tag
+	TransitiveTags []string
+	ExternalID     string
+}
+
+// assumeRole obtains credentials for the target role, either directly with
+// the ID token or, if a hub role is configured, by chaining through it.
+// s.Duration is updated to the granted duration.
+func (h *AwsCredsHandler) assumeRole(ctx context.Context, idToken string, s *sessionRequest) (*awsutils.Credentials, error) {
+	if h.Config.HubRoleARN != "" {
+		return h.assumeRoleViaHub(ctx, idToken, s)
+	}
+	input := &awsutils.WebIdentityInput{
+		RoleArn:          s.RoleArn,
+		RoleSessionName:  s.SessionName,
+		WebIdentityToken: idToken,
+		DurationSeconds:  int32(s.Duration.Seconds()),
+		Policy:           s.Policies.Policy,
+		PolicyARNs:       s.Policies.PolicyARNs,
+	}
+	creds, err := h.STSClient.AssumeRoleWithWebIdentity(ctx, input)
+	// Step down towards the role's limit, which STS does not report
+	for _, d := range fallbackSessionDurations {
+		if !awsutils.IsMaxSessionDurationError(err) {
+			break
+		}
+		if d >= s.Duration {
+			continue
+		}
+		s.Duration = d
+		input.DurationSeconds = int32(s.Duration.Seconds())
+		creds, err = h.STSClient.AssumeRoleWithWebIdentity(ctx, input)
+	}
+	return creds, err
+}
+
+// assumeRoleViaHub assumes the hub role with the ID token, then the target
+// role with the hub session.  Only the hub role has to trust the IdP; target
+// roles trust the hub role instead.
+func (h *AwsCredsHandler) assumeRoleViaHub(ctx context.Context, idToken string, s *sessionRequest) (*awsutils.Credentials, error) {
+	hub, err := h.STSClient.AssumeRoleWithWebIdentity(ctx, &awsutils.WebIdentityInput{
+		RoleArn:          h.Config.HubRoleARN,
+		RoleSessionName:  s.SessionName,
+		WebIdentityToken: idToken,
+		// Only used for the next call
+		DurationSeconds: int32(minSessionDuration.Seconds()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume hub role: %w", err)
+	}
+	s.Duration = min(s.Duration, maxChainedSessionDuration)
+	return h.STSClient.AssumeRole(ctx, &awsutils.AssumeRoleInput{
+		Credentials:       hub,
+		RoleArn:           s.RoleArn,
+		RoleSessionName:   s.SessionName,
+		DurationSeconds:   int32(s.Duration.Seconds()),
+		Policy:            s.Policies.Policy,
+		PolicyARNs:        s.Policies.PolicyARNs,
+		SourceIdentity:    s.SourceIdentity,
+		Tags:              s.Tags,
+		TransitiveTagKeys: s.TransitiveTags,
+		ExternalID:        s.ExternalID,
+	})
+}
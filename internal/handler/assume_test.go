@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+const testHubRoleARN = "arn:aws:iam::111111111111:role/aws-oidc-hub"
+
+// hubFlow runs /creds for role r in account 222222222222 with a handler in
+// hub mode backed by FakeSTS.
+func hubFlow(t *testing.T, cfg Config, claims jwt.MapClaims, duration int32) (events.APIGatewayProxyResponse, []awsutils.FakeSTSRequest) {
+	t.Helper()
+	fake := awsutils.NewFakeSTS()
+	t.Cleanup(fake.Close)
+
+	claims["nonce"] = testNonce
+	raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	h := newTestHandler(nil, (&oauth2.Token{}).WithExtra(map[string]any{"id_token": raw}), nil)
+	h.STSClient = fake.Client()
+	cfg.StateKey = h.Config.StateKey
+	cfg.HubRoleARN = testHubRoleARN
+	h.Config = cfg
+
+	b := CredsRequest{
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "222222222222",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
+		Duration:      duration,
+	}
+	b.State = signTestState(t, h, b)
+	data, _ := json.Marshal(b)
+	resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+	return resp, fake.Requests()
+}
+
+func TestHandleCreds_HubRole(t *testing.T) {
+	cfg := Config{
+		SourceIdentityClaim: "email",
+		ExternalID:          "default-ext",
+		SessionTags:         []SessionTag{{Claim: "department", Key: "Department", Transitive: true}, {Claim: "team"}},
+		Rules:               []RoleRule{{Account: "222222222222", ExternalID: "spoke-ext"}},
+	}
+	resp, reqs := hubFlow(t, cfg, jwt.MapClaims{"email": "foo@bar.com", "department": "R&D"}, 8*3600)
+	require.Equal(t, 200, resp.StatusCode, resp.Body)
+	require.Len(t, reqs, 2)
+
+	hub := reqs[0].Params
+	assert.Equal(t, "AssumeRoleWithWebIdentity", hub.Get("Action"))
+	assert.Equal(t, testHubRoleARN, hub.Get("RoleArn"))
+	assert.Equal(t, "foo@bar.com", hub.Get("RoleSessionName"))
+	assert.Equal(t, "900", hub.Get("DurationSeconds"))
+
+	target := reqs[1].Params
+	assert.Equal(t, "AssumeRole", target.Get("Action"))
+	assert.Equal(t, "ASIA-AssumeRoleWithWebIdentity-foo@bar.com", reqs[1].AccessKeyID, "signed with the hub session")
+	assert.Equal(t, "arn:aws:iam::222222222222:role/r", target.Get("RoleArn"))
+	assert.Equal(t, "foo@bar.com", target.Get("RoleSessionName"))
+	assert.Equal(t, "3600", target.Get("DurationSeconds"), "chained sessions are capped at an hour")
+	assert.Equal(t, "foo@bar.com", target.Get("SourceIdentity"))
+	assert.Equal(t, "spoke-ext", target.Get("ExternalId"))
+	assert.Equal(t, "Department", target.Get("Tags.member.1.Key"))
+	assert.Equal(t, "R-D", target.Get("Tags.member.1.Value"))
+	assert.False(t, target.Has("Tags.member.2.Key"))
+	assert.Equal(t, "Department", target.Get("TransitiveTagKeys.member.1"))
+}
+
+func TestHandleCreds_HubRoleSourceIdentity(t *testing.T) {
+	cfg := Config{SourceIdentityClaim: "email"}
+
+	resp, reqs := hubFlow(t, cfg, jwt.MapClaims{"email": "foo@bar.com", sourceIdentityClaim: "foo@bar.com"}, 0)
+	assert.Equal(t, 200, resp.StatusCode, resp.Body)
+	assert.Len(t, reqs, 2)
+
+	resp, reqs = hubFlow(t, cfg, jwt.MapClaims{"email": "foo@bar.com", sourceIdentityClaim: "someone-else"}, 0)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "must assert")
+	assert.Empty(t, reqs)
+}
+
+func TestHandleCreds_HubRoleError(t *testing.T) {
+	fake := awsutils.NewFakeSTS()
+	defer fake.Close()
+	fake.MaxSessionDuration = 1
+
+	tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+	h := newTestHandler(nil, tok, nil)
+	h.STSClient = fake.Client()
+	h.Config.HubRoleARN = testHubRoleARN
+	b := CredsRequest{Code: "c", Verifier: "v", Account: "123456789012", Role: "r", RedirectURI: testRedirectURI, EncryptionKey: testEncryptionJWK()}
+	b.State = signTestState(t, h, b)
+	data, _ := json.Marshal(b)
+	resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "failed to assume hub role")
+	assert.Len(t, fake.Requests(), 1)
+}
+
+func TestHandleCreds_SessionTagsWebIdentity(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"asserted", jwt.MapClaims{
+			"email": "foo@bar.com",
+			"team":  "platform",
+			tagsClaim: map[string]any{
+				"principal_tags":      map[string]any{"Team": []any{"platform"}},
+				"transitive_tag_keys": []any{"Team"},
+			},
+		}, 200},
+		{"not asserted", jwt.MapClaims{"email": "foo@bar.com", "team": "platform"}, 403},
+		{"claim missing", jwt.MapClaims{"email": "foo@bar.com"}, 200},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var ev audit.Event
+			c.claims["nonce"] = testNonce
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c.claims).SignedString([]byte("secret"))
+			h := newTestHandler(nil, (&oauth2.Token{}).WithExtra(map[string]any{"id_token": raw}), nil)
+			h.Config.SessionTags = []SessionTag{{Claim: "team", Key: "Team", Transitive: true}}
+			h.Config.Audit = audit.SinkFunc(func(ctx context.Context, e audit.Event) error {
+				ev = e
+				return nil
+			})
+			b := CredsRequest{Code: "c", Verifier: "v", Account: "123456789012", Role: "r", RedirectURI: testRedirectURI, EncryptionKey: testEncryptionJWK()}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode, resp.Body)
+			if c.status == 403 {
+				assert.Contains(t, errorBody(t, resp).Message, `must assert session tag Team="platform"`)
+			}
+			if _, ok := c.claims["team"]; ok {
+				assert.Equal(t, map[string]string{"Team": "platform"}, ev.SessionTags)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestHandleCreds_Audit(t *testing.T) {
+	tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+	cases := []struct {
+		name    string
+		stsErr  error
+		outcome string
+		status  int
+		reason  string
+	}{
+		{"issued", nil, audit.OutcomeIssued, 200, ""},
+		{"denied", errors.New("connection reset"), audit.OutcomeDenied, 502, "connection reset"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []audit.Event
+			h := newTestHandler(c.stsErr, tok, nil)
+			h.Config.Audit = audit.SinkFunc(func(ctx context.Context, ev audit.Event) error {
+				got = append(got, ev)
+				return nil
+			})
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			req := events.APIGatewayProxyRequest{
+				Body: string(data),
+				RequestContext: events.APIGatewayProxyRequestContext{
+					RequestID: "req-1",
+					Identity: events.APIGatewayRequestIdentity{
+						SourceIP:  "192.0.2.1",
+						UserAgent: "aws-oidc",
+						UserArn:   "arn:aws:sts::123456789012:assumed-role/bootstrap/ci",
+						APIKeyID:  "abc123",
+					},
+				},
+			}
+			resp, _ := h.HandleCreds(context.Background(), req)
+			assert.Equal(t, c.status, resp.StatusCode)
+
+			require.Len(t, got, 1)
+			ev := got[0]
+			assert.Equal(t, c.outcome, ev.Outcome)
+			assert.Equal(t, c.status, ev.Status)
+			assert.Equal(t, c.reason, ev.Reason)
+			assert.Equal(t, "req-1", ev.RequestID)
+			assert.Equal(t, "192.0.2.1", ev.SourceIP)
+			assert.Equal(t, "aws-oidc", ev.UserAgent)
+			assert.Equal(t, "arn:aws:sts::123456789012:assumed-role/bootstrap/ci", ev.Caller)
+			assert.Equal(t, "abc123", ev.APIKeyID)
+			assert.Equal(t, "foo@bar.com", ev.Email)
+			assert.Equal(t, "123456789012", ev.Account)
+			assert.Equal(t, "r", ev.Role)
+			assert.Equal(t, "foo@bar.com", ev.SessionName)
+			assert.Equal(t, int32(1800), ev.RequestedDuration)
+
+			// Secrets never reach the audit log
+			raw, _ := json.Marshal(ev)
+			assert.NotContains(t, string(raw), `"SK"`)
+			assert.NotContains(t, string(raw), `"ST"`)
+			assert.NotContains(t, string(raw), b.State)
+		})
+	}
+}
+
+func TestHandleCreds_AuditEarlyDenial(t *testing.T) {
+	var got []audit.Event
+	h := newTestHandler(nil, nil, nil)
+	h.Config.Audit = audit.SinkFunc(func(ctx context.Context, ev audit.Event) error {
+		got = append(got, ev)
+		return errors.New("sink down")
+	})
+	resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: "notjson"})
+	assert.Equal(t, 400, resp.StatusCode)
+	require.Len(t, got, 1)
+	assert.Equal(t, audit.OutcomeDenied, got[0].Outcome)
+	assert.Equal(t, "invalid JSON body", got[0].Reason)
+}
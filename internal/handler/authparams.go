@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// defaultAllowedPrompts are the prompt values /auth forwards unless
+// Config.AllowedPrompts says otherwise.  "none" is left out, as the CLI
+// always involves the user.
+var defaultAllowedPrompts = []string{"login", "consent", "select_account"}
+
+// maxHintLen bounds login_hint and domain_hint.
+const maxHintLen = 256
+
+// authParams checks the optional authorization parameters of an /auth
+// request against the server allowlists and returns them as options for the
+// authorization request.  rule may add acr values it requires for step-up.
+func (h *AwsCredsHandler) authParams(query map[string]string, baseScopes []string, rule *RoleRule) ([]oauth2.AuthCodeOption, error) {
+	var opts []oauth2.AuthCodeOption
+	for _, name := range []string{"login_hint", "domain_hint"} {
+		if v := query[name]; v != "" {
+			if len(v) > maxHintLen {
+				return nil, fmt.Errorf("%s too long", name)
+			}
+			opts = append(opts, oauth2.SetAuthURLParam(name, v))
+		}
+	}
+
+	allowedPrompts := h.Config.AllowedPrompts
+	if allowedPrompts == nil {
+		allowedPrompts = defaultAllowedPrompts
+	}
+	if v := query["prompt"]; v != "" {
+		if err := checkAllowed("prompt", v, allowedPrompts); err != nil {
+			return nil, err
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", v))
+	}
+
+	if v := query["acr_values"]; v != "" {
+		if len(h.Config.AllowedACRValues) > 0 {
+			allowed := h.Config.AllowedACRValues
+			if rule != nil {
+				allowed = append(slices.Clip(allowed), rule.ACRValues...)
+			}
+			if err := checkAllowed("acr_values", v, allowed); err != nil {
+				return nil, err
+			}
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", v))
+	}
+
+	if v := query["scope"]; v != "" {
+		if err := checkAllowed("scope", v, append(slices.Clip(baseScopes), h.Config.AllowedScopes...)); err != nil {
+			return nil, err
+		}
+		scopes := slices.Clone(baseScopes)
+		for _, s := range strings.Fields(v) {
+			if !slices.Contains(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("scope", strings.Join(scopes, " ")))
+	}
+	return opts, nil
+}
+
+// checkAllowed requires every space-separated value to be in allowed.
+func checkAllowed(name, values string, allowed []string) error {
+	for _, v := range strings.Fields(values) {
+		if !slices.Contains(allowed, v) {
+			return fmt.Errorf("%s %q not allowed", name, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleAuth_AuthParams(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    Config
+		query  map[string]string
+		want   map[string]string
+		errMsg string
+	}{
+		{"none", Config{}, nil, map[string]string{"prompt": "", "login_hint": "", "scope": "openid profile email"}, ""},
+		{"hints", Config{},
+			map[string]string{"login_hint": "alice@example.com", "domain_hint": "example.com"},
+			map[string]string{"login_hint": "alice@example.com", "domain_hint": "example.com"}, ""},
+		{"hint too long", Config{}, map[string]string{"login_hint": string(make([]byte, maxHintLen+1))}, nil, "login_hint too long"},
+		{"default prompts", Config{}, map[string]string{"prompt": "select_account consent"}, map[string]string{"prompt": "select_account consent"}, ""},
+		{"prompt none", Config{}, map[string]string{"prompt": "none"}, nil, `prompt "none" not allowed`},
+		{"configured prompts", Config{AllowedPrompts: []string{"login"}}, map[string]string{"prompt": "consent"}, nil, `prompt "consent" not allowed`},
+		{"any acr", Config{}, map[string]string{"acr_values": "urn:acr:x"}, map[string]string{"acr_values": "urn:acr:x"}, ""},
+		{"acr allowlist", Config{AllowedACRValues: []string{"mfa"}}, map[string]string{"acr_values": "phrh"}, nil, `acr_values "phrh" not allowed`},
+		{"acr from rule", Config{AllowedACRValues: []string{"mfa"}, Rules: []RoleRule{{Role: "admin", ACRValues: []string{"phrh"}}}},
+			map[string]string{"acr_values": "phrh", "account": "123456789012", "role": "team/admin"}, map[string]string{"acr_values": "phrh"}, ""},
+		{"invalid account", Config{}, map[string]string{"account": "1234567890", "role": "admin"}, nil, `invalid account ID "1234567890"`},
+		{"scope", Config{AllowedScopes: []string{"groups", "offline_access"}},
+			map[string]string{"scope": "groups email"}, map[string]string{"scope": "openid profile email groups"}, ""},
+		{"scope not allowed", Config{AllowedScopes: []string{"groups"}}, map[string]string{"scope": "admin"}, nil, `scope "admin" not allowed`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newTestHandler(nil, nil, nil)
+			c.cfg.StateKey = h.Config.StateKey
+			h.Config = c.cfg
+			query := map[string]string{
+				"state":        "s",
+				"challenge":    "c",
+				"redirect_uri": testRedirectURI,
+				"nonce":        "n",
+			}
+			for k, v := range c.query {
+				query[k] = v
+			}
+			resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: query})
+			if c.errMsg != "" {
+				assert.Equal(t, 400, resp.StatusCode)
+				assert.Equal(t, c.errMsg, errorBody(t, resp).Message)
+				return
+			}
+			require.Equal(t, 302, resp.StatusCode, resp.Body)
+			loc, err := url.Parse(resp.Headers["Location"])
+			require.NoError(t, err)
+			for k, v := range c.want {
+				assert.Equal(t, v, loc.Query().Get(k), k)
+			}
+		})
+	}
+}
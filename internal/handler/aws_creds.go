@@ -2,13 +2,18 @@ package handler
 
 import (
 	"context"
+	"crypto/ecdh"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"time"
+	"log"
+	"net/http"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/golang-jwt/jwt/v5"
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
 	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/michaelw/aws-oidc-cli/internal/jwe"
 	"github.com/michaelw/aws-oidc-cli/internal/oidc"
 	"golang.org/x/oauth2"
 )
@@ -17,13 +22,15 @@ import (
 type AwsCredsHandler struct {
 	OIDCClient oidc.OIDCClient
 	STSClient  awsutils.STSClient
+	Config     Config
 }
 
 // NewAwsCredsHandler constructs a handler with injected dependencies.
-func NewAwsCredsHandler(oidcClient oidc.OIDCClient, stsClient awsutils.STSClient) *AwsCredsHandler {
+func NewAwsCredsHandler(oidcClient oidc.OIDCClient, stsClient awsutils.STSClient, cfg Config) *AwsCredsHandler {
 	return &AwsCredsHandler{
 		OIDCClient: oidcClient,
 		STSClient:  stsClient,
+		Config:     cfg,
 	}
 }
 
@@ -34,116 +41,373 @@ func (h *AwsCredsHandler) Serve(ctx context.Context, req events.APIGatewayProxyR
 		return h.HandleAuth(ctx, req)
 	case "/creds":
 		return h.HandleCreds(ctx, req)
+	case "/jwks":
+		return h.HandleJWKS(ctx, req)
 	default:
-		return events.APIGatewayProxyResponse{StatusCode: 404}, nil
+		return errorResponse(req, newAPIError(http.StatusNotFound, ErrNotFound, errors.New("not found"))), nil
 	}
 }
 
+// StateHeader carries the signed state envelope on /auth responses, so that
+// clients can complete a login from a pasted authorization code.  With PAR
+// the envelope is not part of the redirect URL.
+const StateHeader = "X-OIDC-State"
+
 // HandleAuth is the Lambda handler for /auth as a method.
 func (h *AwsCredsHandler) HandleAuth(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	state := req.QueryStringParameters["state"]
 	challenge := req.QueryStringParameters["challenge"]
 	redirectURI := req.QueryStringParameters["redirect_uri"]
+	nonce := req.QueryStringParameters["nonce"]
+	dpopJKT := req.QueryStringParameters["dpop_jkt"]
 	if state == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing state"}, nil
+		return errorResponse(req, badRequest("missing state")), nil
 	}
 	if challenge == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing challenge"}, nil
+		return errorResponse(req, badRequest("missing challenge")), nil
 	}
 	if redirectURI == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing redirect_uri"}, nil
+		return errorResponse(req, badRequest("missing redirect_uri")), nil
+	}
+	if nonce == "" {
+		return errorResponse(req, badRequest("missing nonce")), nil
+	}
+	if dpopJKT == "" && h.Config.RequireDPoP {
+		return errorResponse(req, badRequest("missing dpop_jkt")), nil
+	}
+	if err := validateRedirectURI(redirectURI, h.Config.AllowedRedirectURIs); err != nil {
+		return errorResponse(req, invalidRequest(err)), nil
+	}
+	account := req.QueryStringParameters["account"]
+	role := req.QueryStringParameters["role"]
+	// They select the rule the authorization parameters are checked against
+	if account != "" || role != "" {
+		if err := validateRole(account, role); err != nil {
+			return errorResponse(req, invalidRequest(err)), nil
+		}
+	}
+	extraOpts, err := h.authParams(req.QueryStringParameters, h.OIDCClient.NewConfig(redirectURI).Scopes, h.Config.ruleFor(account, role))
+	if err != nil {
+		return errorResponse(req, invalidRequest(err)), nil
+	}
+
+	signedState, err := h.signState(StateClaims{
+		State:       state,
+		Challenge:   challenge,
+		RedirectURI: redirectURI,
+		Nonce:       nonce,
+		DPoPJKT:     dpopJKT,
+		EncJKT:      req.QueryStringParameters["enc_jkt"],
+		Account:     account,
+		Role:        role,
+		Provider:    h.Config.Provider,
+	})
+	if err != nil {
+		return errorResponse(req, fmt.Errorf("failed to sign state: %w", err)), nil
 	}
 
-	config := h.OIDCClient.NewConfig(redirectURI)
-	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOnline,
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOnline,
 		oauth2.SetAuthURLParam("code_challenge", challenge),
-		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		coreosoidc.Nonce(nonce),
+	}
+	opts = append(opts, extraOpts...)
+	var authURL string
+	switch {
+	case h.OIDCClient.SupportsPAR():
+		// Keep the authorization parameters out of the browser URL.
+		authURL, err = h.OIDCClient.PushAuthorizationRequest(ctx, redirectURI, signedState, opts...)
+		if err != nil {
+			return errorResponse(req, newAPIError(http.StatusBadGateway, ErrIdPError, err)), nil
+		}
+	case h.Config.RequirePAR:
+		// A mismatch between configuration and IdP that retries cannot fix
+		return errorResponse(req, newAPIError(http.StatusBadGateway, ErrIdPError, errors.New("provider does not support pushed authorization requests"))), nil
+	default:
+		authURL = h.OIDCClient.NewConfig(redirectURI).AuthCodeURL(signedState, opts...)
+	}
 
 	return events.APIGatewayProxyResponse{StatusCode: 302,
 		Headers: map[string]string{
-			"Location": authURL,
+			"Location":  authURL,
+			StateHeader: signedState,
 		},
 	}, nil
 }
 
 // HandleCreds handles the /creds endpoint for OIDC redirect as a method of AwsCredsHandler.
-// Now expects POST with JSON body: { code, verifier, account, role, redirect_uri }
+// Now expects POST with JSON body: { code, verifier, account, role, redirect_uri, state, encryption_key }
+// where state is the signed envelope issued by HandleAuth, and encryption_key
+// is the X25519 key the credentials are sealed to (returned as a compact JWE),
+// whose thumbprint was passed to HandleAuth as enc_jkt.  If the flow was
+// bound to a DPoP key at /auth, the request must carry a matching DPoP proof.
+// Every request is recorded as an audit event, along with the IAM principal
+// or API key API Gateway authorized it with, if any.
 func (h *AwsCredsHandler) HandleCreds(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ev := audit.Event{
+		RequestID: req.RequestContext.RequestID,
+		SourceIP:  req.RequestContext.Identity.SourceIP,
+		UserAgent: req.RequestContext.Identity.UserAgent,
+		Caller:    req.RequestContext.Identity.UserArn,
+		APIKeyID:  req.RequestContext.Identity.APIKeyID,
+		Provider:  h.Config.Provider,
+	}
+	resp, err := h.handleCreds(ctx, req, &ev)
+	if err != nil {
+		resp = errorResponse(req, err)
+	}
+	h.audit(ctx, ev, resp, err)
+	return resp, nil
+}
+
+// handleCreds implements HandleCreds, recording what it learns about the
+// request in ev.  Errors are reported with errorResponse.
+func (h *AwsCredsHandler) handleCreds(ctx context.Context, req events.APIGatewayProxyRequest, ev *audit.Event) (events.APIGatewayProxyResponse, error) {
 	var body CredsRequest
 	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "invalid JSON body"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("invalid JSON body")
 	}
+	ev.Account = body.Account
+	ev.Role = body.Role
 	if body.Code == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing code"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("missing code")
 	}
 	if body.Verifier == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing verifier"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("missing verifier")
 	}
 	if body.Account == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing account ID"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("missing account ID")
 	}
 	if body.Role == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing role"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("missing role")
+	}
+	if err := validateRole(body.Account, body.Role); err != nil {
+		return events.APIGatewayProxyResponse{}, invalidRequest(err)
 	}
 	if body.RedirectURI == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "missing redirect_uri"}, nil
+		return events.APIGatewayProxyResponse{}, badRequest("missing redirect_uri")
 	}
+	if err := validateRedirectURI(body.RedirectURI, h.Config.AllowedRedirectURIs); err != nil {
+		return events.APIGatewayProxyResponse{}, invalidRequest(err)
+	}
+	if body.State == "" {
+		return events.APIGatewayProxyResponse{}, badRequest("missing state")
+	}
+	encryptionKey, err := h.encryptionKey(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, invalidRequest(err)
+	}
+	state, err := h.checkState(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, newAPIError(http.StatusBadRequest, ErrInvalidState, err)
+	}
+	if state.DPoPJKT != "" {
+		if err := h.checkDPoP(req, state.DPoPJKT); err != nil {
+			return events.APIGatewayProxyResponse{}, newAPIError(http.StatusBadRequest, ErrInvalidDPoP, err)
+		}
+	}
+
+	// Check server-side rules before redeeming the single-use code
+	rule := h.Config.ruleFor(body.Account, body.Role)
+	policies, err := resolveSessionPolicies(rule, body.Policy, body.PolicyARNs)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, invalidRequest(err)
+	}
+	ev.SessionPolicy = policies.Policy != ""
+	ev.PolicyARNs = policies.PolicyARNs
+	duration, err := sessionDuration(rule, body.Duration)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, invalidRequest(err)
+	}
+	ev.RequestedDuration = int32(duration.Seconds())
 
 	token, err := h.OIDCClient.ExchangeCode(ctx, body.Code, body.Verifier, body.RedirectURI)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		return events.APIGatewayProxyResponse{}, idpError(err)
 	}
 	idToken, ok := token.Extra("id_token").(string)
 	if !ok || idToken == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "no id_token in token response"}, nil
+		return events.APIGatewayProxyResponse{}, newAPIError(http.StatusBadGateway, ErrIdPError, errors.New("no id_token in token response"))
 	}
 
-	// Parse email from idToken
-	claims, err := parseIDTokenClaimsUnverified(idToken)
+	// Verify idToken, and that it was issued for this flow
+	verified, err := h.OIDCClient.VerifyIDToken(ctx, idToken, token.AccessToken)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: fmt.Sprintf("failed to parse id_token: %v", err)}, nil
+		return events.APIGatewayProxyResponse{}, newAPIError(http.StatusUnauthorized, ErrInvalidToken, fmt.Errorf("invalid id_token: %w", err))
 	}
-	if claims.Email == "" {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: "email claim not found in id_token"}, nil
+	if state.Nonce == "" || verified.Nonce != state.Nonce {
+		return events.APIGatewayProxyResponse{}, newAPIError(http.StatusUnauthorized, ErrInvalidToken, errors.New("id_token nonce mismatch"))
+	}
+
+	// Parse identity from idToken
+	ev.Issuer = verified.Issuer
+	ev.Subject = verified.Subject
+	var allClaims map[string]any
+	if err := verified.Claims(&allClaims); err != nil {
+		return events.APIGatewayProxyResponse{}, newAPIError(http.StatusUnauthorized, ErrInvalidToken, fmt.Errorf("failed to parse id_token: %w", err))
+	}
+	// Authentication requirements only apply to the ID token itself
+	if err := checkAuthentication(rule, allClaims); err != nil {
+		return events.APIGatewayProxyResponse{}, err.apiError()
+	}
+	if err := h.mergeUserInfo(ctx, token.AccessToken, allClaims); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	ev.Email, _ = allClaims["email"].(string)
+
+	sessionName, err := renderSessionName(h.Config.SessionNameTemplate, allClaims)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, claimsRejected(fmt.Errorf("failed to build role session name: %w", err))
+	}
+	ev.SessionName = sessionName
+	sourceIdentity, err := h.sourceIdentity(allClaims)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, claimsRejected(err)
+	}
+	tags, transitiveTags := sessionTags(h.Config.SessionTags, allClaims)
+	ev.SessionTags = auditTags(tags)
+	if h.Config.HubRoleARN == "" {
+		if err := checkTagsClaim(allClaims, tags, transitiveTags); err != nil {
+			return events.APIGatewayProxyResponse{}, claimsRejected(err)
+		}
 	}
-	email := claims.Email
 
 	// Call STS
-	roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", body.Account, body.Role)
-	duration := 30 * time.Minute // must be > 15 minutes, otherwise awscli will attempt to immediately refresh the token
-	ak, sk, st, exp, err := h.STSClient.AssumeRoleWithWebIdentity(ctx, roleArn, email, idToken, int32(duration.Seconds()))
+	session := &sessionRequest{
+		RoleArn:        fmt.Sprintf("arn:aws:iam::%s:role/%s", body.Account, body.Role),
+		SessionName:    sessionName,
+		Duration:       duration,
+		Policies:       policies,
+		SourceIdentity: sourceIdentity,
+		Tags:           tags,
+		TransitiveTags: transitiveTags,
+		ExternalID:     h.Config.externalID(rule),
+	}
+	creds, err := h.assumeRole(ctx, idToken, session)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		return events.APIGatewayProxyResponse{}, stsError(err)
 	}
+	ev.GrantedDuration = int32(session.Duration.Seconds())
+	ev.AccessKeyID = creds.AccessKeyID
+	ev.SourceIdentity = creds.SourceIdentity
 
 	// Return credentials in AWS credential_process format
 	resp := CredsResponse{
 		Version:         1,
-		AccessKeyId:     ak,
-		SecretAccessKey: sk,
-		SessionToken:    st,
-		Expiration:      *exp,
+		AccessKeyId:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      *creds.Expiration,
 	}
 	b, _ := json.Marshal(resp)
+	if encryptionKey == nil {
+		return events.APIGatewayProxyResponse{StatusCode: 200,
+			Body:    string(b),
+			Headers: map[string]string{"Content-Type": "application/json"},
+		}, nil
+	}
+
+	// Seal credentials to the CLI's ephemeral key, so they are never in plaintext in transit logs
+	sealed, err := jwe.Encrypt(b, encryptionKey)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to encrypt credentials: %w", err)
+	}
 	return events.APIGatewayProxyResponse{StatusCode: 200,
-		Body:    string(b),
-		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    sealed,
+		Headers: map[string]string{"Content-Type": jwe.ContentType},
 	}, nil
 }
 
-// IDTokenClaims holds the claims we care about from the ID token
-// (expand as needed for more claims)
-type IDTokenClaims struct {
-	Email string `json:"email"`
-	jwt.RegisteredClaims
-}
-
-// parseIDTokenClaimsUnverified parses a JWT and returns the claims (without verifying signature)
-func parseIDTokenClaimsUnverified(idToken string) (*IDTokenClaims, error) {
-	claims := &IDTokenClaims{}
-	_, _, err := new(jwt.Parser).ParseUnverified(idToken, claims)
+// checkState verifies the state envelope and that the request matches the
+// flow it was issued for.
+func (h *AwsCredsHandler) checkState(body CredsRequest) (*StateClaims, error) {
+	claims, err := h.verifyState(body.State)
 	if err != nil {
 		return nil, err
 	}
+	if oauth2.S256ChallengeFromVerifier(body.Verifier) != claims.Challenge {
+		return nil, fmt.Errorf("%w: verifier does not match challenge", errInvalidState)
+	}
+	if claims.Provider != h.Config.Provider {
+		return nil, fmt.Errorf("%w: provider mismatch", errInvalidState)
+	}
+	if claims.RedirectURI != body.RedirectURI {
+		return nil, fmt.Errorf("%w: redirect_uri mismatch", errInvalidState)
+	}
+	if claims.Account != "" && claims.Account != body.Account {
+		return nil, fmt.Errorf("%w: account mismatch", errInvalidState)
+	}
+	if claims.Role != "" && claims.Role != body.Role {
+		return nil, fmt.Errorf("%w: role mismatch", errInvalidState)
+	}
+	// Otherwise whoever captures the code could have the credentials sealed
+	// to their own key
+	var encJKT string
+	if body.EncryptionKey != nil {
+		encJKT = body.EncryptionKey.Thumbprint()
+	}
+	if claims.EncJKT != encJKT {
+		return nil, fmt.Errorf("%w: encryption_key mismatch", errInvalidState)
+	}
 	return claims, nil
 }
+
+// audit records the outcome of a /creds request.  Failures to deliver the
+// event are logged but do not affect the response.
+func (h *AwsCredsHandler) audit(ctx context.Context, ev audit.Event, resp events.APIGatewayProxyResponse, err error) {
+	if h.Config.Audit == nil {
+		return
+	}
+	ev.Status = resp.StatusCode
+	if resp.StatusCode == 200 {
+		ev.Outcome = audit.OutcomeIssued
+	} else {
+		ev.Outcome = audit.OutcomeDenied
+		ev.Reason = err.Error()
+	}
+	if err := h.Config.Audit.Emit(ctx, ev); err != nil {
+		log.Printf("failed to emit audit event: %v", err)
+	}
+}
+
+// sourceIdentity returns the source identity derived from the configured
+// claim, or "" if none is configured.  AssumeRoleWithWebIdentity cannot set a
+// source identity itself; STS takes it from the token's
+// https://aws.amazon.com/source_identity claim, which the IdP must populate.
+// With a hub role, AssumeRole sets it instead and the token may omit it.
+func (h *AwsCredsHandler) sourceIdentity(claims map[string]any) (string, error) {
+	if h.Config.SourceIdentityClaim == "" {
+		return "", nil
+	}
+	value, err := claimString(claims, h.Config.SourceIdentityClaim)
+	if err != nil {
+		return "", err
+	}
+	want, err := sanitizeSTSIdentifier(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid source identity: %w", err)
+	}
+	// A source identity asserted for the hub session cannot be changed
+	got, ok := claims[sourceIdentityClaim].(string)
+	if got != want && (ok || h.Config.HubRoleARN == "") {
+		return "", fmt.Errorf("id_token must assert %s %q", sourceIdentityClaim, want)
+	}
+	return want, nil
+}
+
+// encryptionKey returns the key to seal the response to, or nil if the client
+// sent none and plaintext responses are allowed.
+func (h *AwsCredsHandler) encryptionKey(body CredsRequest) (*ecdh.PublicKey, error) {
+	if body.EncryptionKey == nil {
+		if h.Config.AllowPlaintextCredentials {
+			return nil, nil
+		}
+		return nil, errors.New("missing encryption_key")
+	}
+	key, err := body.EncryptionKey.PublicKey()
+	if err != nil {
+		return nil, errors.New("invalid encryption_key")
+	}
+	return key, nil
+}
@@ -2,15 +2,22 @@ package handler
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"maps"
+	"net/url"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/golang-jwt/jwt/v5"
 	awsutils "github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/michaelw/aws-oidc-cli/internal/jwe"
 	"github.com/michaelw/aws-oidc-cli/internal/oidc"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
@@ -29,17 +36,63 @@ func newTestHandler(stsErr error, token *oauth2.Token, tokenErr error) *AwsCreds
 			},
 		},
 		&awsutils.MockSTSClient{
-			AssumeRoleWithWebIdentityFunc: func(ctx context.Context, roleArn, roleSessionName, webIdentityToken string, durationSeconds int32) (string, string, string, *time.Time, error) {
+			AssumeRoleWithWebIdentityFunc: func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
 				if stsErr != nil {
-					return "", "", "", nil, stsErr
+					return nil, stsErr
 				}
 				exp := time.Now().Add(1 * time.Hour)
-				return "AKIA", "SK", "ST", &exp, nil
+				return &awsutils.Credentials{AccessKeyID: "AKIA", SecretAccessKey: "SK", SessionToken: "ST", Expiration: &exp}, nil
 			},
 		},
+		Config{StateKey: []byte("test-state-key")},
 	)
 }
 
+// newFakeIdPHandler returns a handler backed by a real oidcClient talking to idp.
+func newFakeIdPHandler(t *testing.T, idp *oidc.FakeIdP, cfg Config) *AwsCredsHandler {
+	provider, err := coreosoidc.NewProvider(context.Background(), idp.URL)
+	if err != nil {
+		t.Fatalf("failed to discover fake IdP: %v", err)
+	}
+	cfg.StateKey = []byte("test-state-key")
+	return NewAwsCredsHandler(oidc.NewOIDCClient(provider, "clientid", "secret"), &awsutils.MockSTSClient{}, cfg)
+}
+
+// signTestState issues a state envelope matching the given request, as HandleAuth would.
+func signTestState(t *testing.T, h *AwsCredsHandler, b CredsRequest) string {
+	var encJKT string
+	if b.EncryptionKey != nil {
+		encJKT = b.EncryptionKey.Thumbprint()
+	}
+	s, err := h.signState(StateClaims{
+		State:       "s",
+		Challenge:   oauth2.S256ChallengeFromVerifier(b.Verifier),
+		RedirectURI: b.RedirectURI,
+		Nonce:       testNonce,
+		Account:     b.Account,
+		Role:        b.Role,
+		EncJKT:      encJKT,
+		Provider:    h.Config.Provider,
+	})
+	if err != nil {
+		t.Fatalf("failed to sign test state: %v", err)
+	}
+	return s
+}
+
+const (
+	testRedirectURI = "http://127.0.0.1:49152/creds"
+	testNonce       = "n"
+)
+
+// testEncryptionKey stands in for the CLI's ephemeral response encryption key.
+var testEncryptionKey, _ = ecdh.X25519().GenerateKey(rand.Reader)
+
+func testEncryptionJWK() *jwe.JWK {
+	k := jwe.PublicJWK(testEncryptionKey.PublicKey())
+	return &k
+}
+
 func TestHandleAuth_MissingParams(t *testing.T) {
 	h := newTestHandler(nil, nil, nil)
 	cases := []struct {
@@ -47,9 +100,10 @@ func TestHandleAuth_MissingParams(t *testing.T) {
 		params map[string]string
 		errMsg string
 	}{
-		{"missing state", map[string]string{"challenge": "c", "redirect_uri": "r"}, "missing state"},
-		{"missing challenge", map[string]string{"state": "s", "redirect_uri": "r"}, "missing challenge"},
-		{"missing redirect_uri", map[string]string{"state": "s", "challenge": "c"}, "missing redirect_uri"},
+		{"missing state", map[string]string{"challenge": "c", "redirect_uri": "r", "nonce": "n"}, "missing state"},
+		{"missing challenge", map[string]string{"state": "s", "redirect_uri": "r", "nonce": "n"}, "missing challenge"},
+		{"missing redirect_uri", map[string]string{"state": "s", "challenge": "c", "nonce": "n"}, "missing redirect_uri"},
+		{"missing nonce", map[string]string{"state": "s", "challenge": "c", "redirect_uri": "r"}, "missing nonce"},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -61,15 +115,112 @@ func TestHandleAuth_MissingParams(t *testing.T) {
 	}
 }
 
+func TestHandleAuth_InvalidRedirectURI(t *testing.T) {
+	h := newTestHandler(nil, nil, nil)
+	req := events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{
+		"state":        "s",
+		"challenge":    "c",
+		"redirect_uri": "http://evil.example.com/creds",
+		"nonce":        "n",
+	}}
+	resp, _ := h.HandleAuth(context.Background(), req)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "invalid redirect_uri")
+}
+
+func TestHandleAuth_Redirect(t *testing.T) {
+	h := newTestHandler(nil, nil, nil)
+	req := events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{
+		"state":        "s",
+		"challenge":    "c",
+		"redirect_uri": testRedirectURI,
+		"nonce":        "n",
+		"enc_jkt":      "jkt",
+	}}
+	resp, _ := h.HandleAuth(context.Background(), req)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Contains(t, resp.Headers["Location"], "redirect_uri="+url.QueryEscape(testRedirectURI))
+	assert.Contains(t, resp.Headers["Location"], "nonce=n")
+
+	loc, err := url.Parse(resp.Headers["Location"])
+	assert.NoError(t, err)
+	claims, err := h.verifyState(loc.Query().Get("state"))
+	assert.NoError(t, err)
+	assert.Equal(t, loc.Query().Get("state"), resp.Headers[StateHeader])
+	assert.Equal(t, "s", claims.State)
+	assert.Equal(t, "c", claims.Challenge)
+	assert.Equal(t, testRedirectURI, claims.RedirectURI)
+	assert.Equal(t, "n", claims.Nonce)
+	assert.Equal(t, "jkt", claims.EncJKT)
+}
+
+func TestHandleAuth_PAR(t *testing.T) {
+	idp := oidc.NewFakeIdP()
+	defer idp.Close()
+	params := map[string]string{
+		"state":        "s",
+		"challenge":    "c",
+		"redirect_uri": testRedirectURI,
+		"nonce":        "n",
+	}
+
+	t.Run("pushed when advertised", func(t *testing.T) {
+		idp.PAR = true
+		defer func() { idp.PAR = false }()
+		h := newFakeIdPHandler(t, idp, Config{})
+		resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+		assert.Equal(t, 302, resp.StatusCode)
+		loc, err := url.Parse(resp.Headers["Location"])
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"client_id", "request_uri"}, slices.Collect(maps.Keys(loc.Query())))
+		_, err = h.verifyState(resp.Headers[StateHeader])
+		assert.NoError(t, err, "state is returned even though it is not in the URL")
+		pushed := idp.Pushed()
+		if assert.NotEmpty(t, pushed) {
+			assert.Equal(t, "c", pushed[len(pushed)-1].Get("code_challenge"))
+			assert.Equal(t, testRedirectURI, pushed[len(pushed)-1].Get("redirect_uri"))
+		}
+	})
+
+	t.Run("required but not advertised", func(t *testing.T) {
+		h := newFakeIdPHandler(t, idp, Config{RequirePAR: true})
+		resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+		assert.Equal(t, 502, resp.StatusCode)
+		e := errorBody(t, resp)
+		assert.Equal(t, ErrIdPError, e.Code)
+		assert.False(t, e.Retryable)
+		assert.Contains(t, e.Message, "does not support pushed authorization requests")
+	})
+
+	t.Run("front channel when not advertised", func(t *testing.T) {
+		h := newFakeIdPHandler(t, idp, Config{})
+		resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Contains(t, resp.Headers["Location"], "code_challenge=c")
+	})
+
+	t.Run("push rejected", func(t *testing.T) {
+		idp.PAR = true
+		idp.PARError = "invalid_request"
+		defer func() { idp.PAR, idp.PARError = false, "" }()
+		h := newFakeIdPHandler(t, idp, Config{})
+		resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+		assert.Equal(t, 502, resp.StatusCode)
+		assert.Contains(t, resp.Body, "invalid_request")
+	})
+}
+
 func TestHandleCreds_MissingFields(t *testing.T) {
 	h := newTestHandler(nil, nil, nil)
 	base := CredsRequest{
-		Code:        "c",
-		Verifier:    "v",
-		Account:     "a",
-		Role:        "r",
-		RedirectURI: "u",
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "123456789012",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
 	}
+	base.State = signTestState(t, h, base)
 	fields := []struct {
 		name   string
 		modify func(*CredsRequest)
@@ -80,6 +231,20 @@ func TestHandleCreds_MissingFields(t *testing.T) {
 		{"missing account", func(b *CredsRequest) { b.Account = "" }, "missing account ID"},
 		{"missing role", func(b *CredsRequest) { b.Role = "" }, "missing role"},
 		{"missing redirect_uri", func(b *CredsRequest) { b.RedirectURI = "" }, "missing redirect_uri"},
+		{"invalid redirect_uri", func(b *CredsRequest) { b.RedirectURI = "http://evil.example.com/creds" }, "invalid redirect_uri"},
+		{"missing state", func(b *CredsRequest) { b.State = "" }, "missing state"},
+		{"missing encryption_key", func(b *CredsRequest) { b.EncryptionKey = nil }, "missing encryption_key"},
+		{"invalid encryption_key", func(b *CredsRequest) { b.EncryptionKey = &jwe.JWK{Kty: "OKP", Crv: "X25519", X: "AA"} }, "invalid encryption_key"},
+		{"forged state", func(b *CredsRequest) { b.State = createTestJWT(t, "foo@bar.com") }, "invalid state"},
+		{"wrong verifier", func(b *CredsRequest) { b.Verifier = "other" }, "verifier does not match challenge"},
+		{"wrong redirect_uri", func(b *CredsRequest) { b.RedirectURI = "http://[::1]:49152/creds" }, "redirect_uri mismatch"},
+		{"wrong account", func(b *CredsRequest) { b.Account = "210987654321" }, "account mismatch"},
+		{"wrong role", func(b *CredsRequest) { b.Role = "other" }, "role mismatch"},
+		{"other encryption_key", func(b *CredsRequest) {
+			k, _ := ecdh.X25519().GenerateKey(rand.Reader)
+			jwk := jwe.PublicJWK(k.PublicKey())
+			b.EncryptionKey = &jwk
+		}, "encryption_key mismatch"},
 	}
 	for _, f := range fields {
 		t.Run(f.name, func(t *testing.T) {
@@ -105,41 +270,77 @@ func TestHandleCreds_InvalidJSON(t *testing.T) {
 func TestHandleCreds_STSError(t *testing.T) {
 	tok := &oauth2.Token{}
 	tok = tok.WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
-	h := newTestHandler(errors.New("sts error"), tok, nil)
+	h := newTestHandler(&smithy.GenericAPIError{Code: "AccessDenied", Message: "Not authorized to perform sts:AssumeRoleWithWebIdentity"}, tok, nil)
 	b := CredsRequest{
-		Code:        "c",
-		Verifier:    "v",
-		Account:     "a",
-		Role:        "r",
-		RedirectURI: "u",
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "123456789012",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
 	}
+	b.State = signTestState(t, h, b)
 	data, _ := json.Marshal(b)
 	req := events.APIGatewayProxyRequest{Body: string(data)}
 	resp, _ := h.HandleCreds(context.Background(), req)
-	assert.Equal(t, 400, resp.StatusCode)
-	assert.Contains(t, resp.Body, "sts error")
+	assert.Equal(t, 403, resp.StatusCode)
+	e := errorBody(t, resp)
+	assert.Equal(t, ErrAccessDenied, e.Code)
+	assert.Contains(t, e.Message, "Not authorized")
+	assert.False(t, e.Retryable)
 }
 
 func TestHandleCreds_ValidFlow(t *testing.T) {
 	tok := &oauth2.Token{}
 	tok = tok.WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
 	h := newTestHandler(nil, tok, nil)
+	b := CredsRequest{
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "123456789012",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
+	}
+	b.State = signTestState(t, h, b)
+	data, _ := json.Marshal(b)
+	req := events.APIGatewayProxyRequest{Body: string(data)}
+	resp, _ := h.HandleCreds(context.Background(), req)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, jwe.ContentType, resp.Headers["Content-Type"])
+	assert.NotContains(t, resp.Body, "SecretAccessKey")
+
+	plaintext, err := jwe.Decrypt(resp.Body, testEncryptionKey)
+	assert.NoError(t, err)
+	var creds CredsResponse
+	assert.NoError(t, json.Unmarshal(plaintext, &creds))
+	assert.Equal(t, "AKIA", creds.AccessKeyId)
+	assert.Equal(t, "SK", creds.SecretAccessKey)
+}
+
+func TestHandleCreds_PlaintextCompatibility(t *testing.T) {
+	tok := &oauth2.Token{}
+	tok = tok.WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+	h := newTestHandler(nil, tok, nil)
+	h.Config.AllowPlaintextCredentials = true
 	b := CredsRequest{
 		Code:        "c",
 		Verifier:    "v",
-		Account:     "a",
+		Account:     "123456789012",
 		Role:        "r",
-		RedirectURI: "u",
+		RedirectURI: testRedirectURI,
 	}
+	b.State = signTestState(t, h, b)
 	data, _ := json.Marshal(b)
 	req := events.APIGatewayProxyRequest{Body: string(data)}
 	resp, _ := h.HandleCreds(context.Background(), req)
 	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Headers["Content-Type"])
 	assert.Contains(t, resp.Body, "AccessKeyId")
 }
 
 func createTestJWT(t *testing.T, email string) string {
-	claims := jwt.MapClaims{"email": email}
+	claims := jwt.MapClaims{"email": email, "nonce": testNonce}
 	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	s, err := tok.SignedString([]byte("secret"))
 	if err != nil {
@@ -155,16 +356,41 @@ func TestServe_UnknownPath(t *testing.T) {
 	assert.Equal(t, 404, resp.StatusCode)
 }
 
-func TestParseIDTokenClaimsUnverified(t *testing.T) {
-	// Valid JWT with email claim
-	claims := jwt.MapClaims{"email": "foo@bar.com"}
-	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	s, _ := tok.SignedString([]byte("secret"))
-	parsed, err := parseIDTokenClaimsUnverified(s)
-	assert.NoError(t, err)
-	assert.Equal(t, "foo@bar.com", parsed.Email)
-
-	// Invalid JWT
-	_, err = parseIDTokenClaimsUnverified("notatoken")
-	assert.Error(t, err)
+func TestHandleCreds_IDTokenChecks(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+		verify func(ctx context.Context, rawIDToken, accessToken string) (*oidc.IDToken, error)
+		errMsg string
+	}{
+		{"nonce mismatch", jwt.MapClaims{"email": "foo@bar.com", "nonce": "other"}, nil, "id_token nonce mismatch"},
+		{"missing nonce", jwt.MapClaims{"email": "foo@bar.com"}, nil, "id_token nonce mismatch"},
+		{"verification failed", jwt.MapClaims{"email": "foo@bar.com", "nonce": testNonce},
+			func(ctx context.Context, rawIDToken, accessToken string) (*oidc.IDToken, error) {
+				return nil, errors.New("bad signature")
+			}, "invalid id_token: bad signature"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c.claims).SignedString([]byte("secret"))
+			tok := (&oauth2.Token{AccessToken: "at"}).WithExtra(map[string]any{"id_token": raw})
+			h := newTestHandler(nil, tok, nil)
+			h.OIDCClient.(*oidc.MockOIDCClient).VerifyIDTokenFunc = c.verify
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, 401, resp.StatusCode)
+			e := errorBody(t, resp)
+			assert.Equal(t, ErrInvalidToken, e.Code)
+			assert.Contains(t, e.Message, c.errMsg)
+		})
+	}
 }
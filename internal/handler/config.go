@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+)
+
+// Config holds server-side settings for AwsCredsHandler.
+type Config struct {
+	// Provider names the issuer this handler serves when several are
+	// configured.  State envelopes are bound to it, so that a flow started
+	// with one issuer cannot be completed with another.
+	Provider string
+
+	// AllowedRedirectURIs lists redirect URIs accepted in addition to the
+	// loopback callbacks http://127.0.0.1:<port>/creds and http://[::1]:<port>/creds.
+	// Entries are matched exactly.
+	AllowedRedirectURIs []string
+
+	// StateKey is the HMAC key used to sign the state envelope binding /auth
+	// to /creds.  All instances serving the API must share it.
+	StateKey []byte
+
+	// StateTTL limits how long a state envelope stays valid.  Defaults to 10 minutes.
+	StateTTL time.Duration
+
+	// RequirePAR rejects /auth requests unless the provider supports pushed
+	// authorization requests (RFC 9126).  PAR is used whenever the provider
+	// advertises it, regardless of this setting.
+	RequirePAR bool
+
+	// RequireDPoP rejects /auth requests that do not bind a DPoP key
+	// (dpop_jkt).  Flows that do bind one always require a proof at /creds.
+	RequireDPoP bool
+
+	// PublicURL is the externally visible base URL of the API, e.g.
+	// https://creds.example.com.  It is used to check the htu claim of DPoP
+	// proofs; if empty, the URL is derived from the API Gateway request.
+	PublicURL string
+
+	// AllowPlaintextCredentials lets clients that do not send an
+	// encryption_key receive credentials as plain JSON.  For compatibility
+	// with older clients only.
+	AllowPlaintextCredentials bool
+
+	// Audit receives one event per /creds request.  Nil disables auditing.
+	Audit audit.Sink
+
+	// SessionNameTemplate is a text/template rendered against the ID token
+	// claims to form the RoleSessionName, e.g. "{{.preferred_username}}".
+	// The result is sanitized and truncated to what STS accepts.  Defaults
+	// to "{{.email}}".
+	SessionNameTemplate string
+
+	// SourceIdentityClaim names the claim the session's SourceIdentity is
+	// derived from.  If set, the ID token must carry the sanitized value in
+	// its https://aws.amazon.com/source_identity claim.
+	SourceIdentityClaim string
+
+	// Rules hold per-role server-side policy, evaluated in order.
+	Rules []RoleRule
+
+	// AllowedPrompts lists the prompt values /auth forwards to the IdP.
+	// Defaults to login, consent and select_account.
+	AllowedPrompts []string
+
+	// AllowedACRValues lists the acr_values /auth forwards to the IdP, in
+	// addition to those a matching rule requires.  Empty allows any.
+	AllowedACRValues []string
+
+	// AllowedScopes lists scopes clients may request with scope, in
+	// addition to those the OIDC client always requests.
+	AllowedScopes []string
+
+	// HubRoleARN, if set, is assumed with the ID token instead of the target
+	// role, which is then assumed from the hub session with AssumeRole.  Only
+	// the hub role has to trust the IdP.  Chained sessions last at most an hour.
+	HubRoleARN string
+
+	// ExternalID is passed to AssumeRole for target roles, unless a rule
+	// overrides it.  Only used with HubRoleARN.
+	ExternalID string
+
+	// SessionTags map ID token claims to session tags.  With HubRoleARN they
+	// are set on the target role session; otherwise the ID token must assert
+	// them in its https://aws.amazon.com/tags claim.
+	SessionTags []SessionTag
+
+	// ClientKeys returns the keys the OIDC client authenticates with using
+	// private_key_jwt.  If set, their public keys are served at /jwks.
+	ClientKeys func(ctx context.Context) ([]oidc.SigningKey, error)
+}
+
+// externalID returns the external ID to present to the target role.
+func (c Config) externalID(rule *RoleRule) string {
+	if rule != nil && rule.ExternalID != "" {
+		return rule.ExternalID
+	}
+	return c.ExternalID
+}
+
+// Validate checks the configuration for errors that would otherwise only
+// surface on the first request.
+func (c Config) Validate() error {
+	if _, err := parseSessionNameTemplate(c.SessionNameTemplate); err != nil {
+		return fmt.Errorf("invalid session name template: %w", err)
+	}
+	if err := validateSessionTags(c.SessionTags); err != nil {
+		return err
+	}
+	for i, r := range c.Rules {
+		if _, err := resolveSessionPolicies(&r, "", nil); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if r.MaxDuration != 0 {
+			if _, err := sessionDuration(nil, r.MaxDuration); err != nil {
+				return fmt.Errorf("rule %d: invalid max_duration: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/michaelw/aws-oidc-cli/internal/dpop"
+)
+
+// checkDPoP verifies the request's DPoP proof against the key thumbprint
+// bound into the state envelope at /auth.
+func (h *AwsCredsHandler) checkDPoP(req events.APIGatewayProxyRequest, jkt string) error {
+	proof := header(req, dpop.HeaderName)
+	if proof == "" {
+		return fmt.Errorf("%w: missing %s header", dpop.ErrInvalidProof, dpop.HeaderName)
+	}
+	got, err := dpop.Verify(proof, http.MethodPost, h.requestURL(req))
+	if err != nil {
+		return err
+	}
+	if got != jkt {
+		return fmt.Errorf("%w: key does not match dpop_jkt", dpop.ErrInvalidProof)
+	}
+	return nil
+}
+
+// requestURL reconstructs the public URL of the request, as the client sees
+// it.  Config.PublicURL takes precedence for custom domains and proxies.
+func (h *AwsCredsHandler) requestURL(req events.APIGatewayProxyRequest) string {
+	if h.Config.PublicURL != "" {
+		return strings.TrimSuffix(h.Config.PublicURL, "/") + req.Path
+	}
+	scheme := header(req, "X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+	path := req.RequestContext.Path // includes the stage, e.g. /Prod/creds
+	if path == "" {
+		path = req.Path
+	}
+	return scheme + "://" + header(req, "Host") + path
+}
+
+// header returns the named request header, matched case-insensitively.
+func header(req events.APIGatewayProxyRequest, name string) string {
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
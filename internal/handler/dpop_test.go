@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/michaelw/aws-oidc-cli/internal/dpop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestHandleCreds_DPoP(t *testing.T) {
+	tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+	h := newTestHandler(nil, tok, nil)
+	signer, err := dpop.NewSigner()
+	require.NoError(t, err)
+	other, err := dpop.NewSigner()
+	require.NoError(t, err)
+
+	b := CredsRequest{
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "123456789012",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
+	}
+	b.State, err = h.signState(StateClaims{
+		Challenge:   oauth2.S256ChallengeFromVerifier(b.Verifier),
+		RedirectURI: b.RedirectURI,
+		Nonce:       testNonce,
+		DPoPJKT:     signer.Thumbprint(),
+		EncJKT:      b.EncryptionKey.Thumbprint(),
+	})
+	require.NoError(t, err)
+	data, _ := json.Marshal(b)
+
+	const credsURL = "https://api.example.com/Prod/creds"
+	proof := func(s *dpop.Signer, uri string) string {
+		p, err := s.Proof("POST", uri)
+		require.NoError(t, err)
+		return p
+	}
+	cases := []struct {
+		name   string
+		proof  string
+		status int
+		errMsg string
+	}{
+		{"valid proof", proof(signer, credsURL), 200, ""},
+		{"missing proof", "", 400, "missing DPoP header"},
+		{"other key", proof(other, credsURL), 400, "key does not match dpop_jkt"},
+		{"wrong url", proof(signer, "https://evil.example.com/Prod/creds"), 400, "htu mismatch"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := events.APIGatewayProxyRequest{
+				Path:           "/creds",
+				Body:           string(data),
+				Headers:        map[string]string{"Host": "api.example.com"},
+				RequestContext: events.APIGatewayProxyRequestContext{Path: "/Prod/creds"},
+			}
+			if c.proof != "" {
+				req.Headers["dpop"] = c.proof
+			}
+			resp, _ := h.HandleCreds(context.Background(), req)
+			assert.Equal(t, c.status, resp.StatusCode)
+			assert.Contains(t, resp.Body, c.errMsg)
+		})
+	}
+}
+
+func TestHandleAuth_RequireDPoP(t *testing.T) {
+	h := newTestHandler(nil, nil, nil)
+	h.Config.RequireDPoP = true
+	params := map[string]string{
+		"state":        "s",
+		"challenge":    "c",
+		"redirect_uri": testRedirectURI,
+		"nonce":        "n",
+	}
+	resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "missing dpop_jkt")
+
+	params["dpop_jkt"] = "jkt"
+	resp, _ = h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params})
+	assert.Equal(t, 302, resp.StatusCode)
+}
+
+func TestRequestURL(t *testing.T) {
+	req := events.APIGatewayProxyRequest{
+		Path:           "/creds",
+		Headers:        map[string]string{"host": "abc.execute-api.us-east-1.amazonaws.com"},
+		RequestContext: events.APIGatewayProxyRequestContext{Path: "/Prod/creds"},
+	}
+	h := &AwsCredsHandler{}
+	assert.Equal(t, "https://abc.execute-api.us-east-1.amazonaws.com/Prod/creds", h.requestURL(req))
+
+	req.Headers["X-Forwarded-Proto"] = "http"
+	assert.Equal(t, "http://abc.execute-api.us-east-1.amazonaws.com/Prod/creds", h.requestURL(req))
+
+	h.Config.PublicURL = "https://creds.example.com/"
+	assert.Equal(t, "https://creds.example.com/creds", h.requestURL(req))
+}
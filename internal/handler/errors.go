@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+	"golang.org/x/oauth2"
+)
+
+// Error codes of ErrorResponse.  They are stable, so clients may act on them;
+// messages are for humans and may change.
+const (
+	ErrInvalidRequest = "invalid_request"
+	ErrInvalidState   = "invalid_state"
+	ErrInvalidDPoP    = "invalid_dpop_proof"
+	// ErrInvalidGrant is the IdP rejecting the authorization code, e.g.
+	// because it expired or was already used.  Clients should log in again.
+	ErrInvalidGrant = "invalid_grant"
+	ErrInvalidToken = "invalid_id_token"
+	// ErrClaimsRejected is an ID token that lacks or misstates the claims the
+	// server requires, such as those for the session name or tags.
+	ErrClaimsRejected = "claims_rejected"
+	// ErrStepUpRequired is returned when the ID token does not meet the
+	// authentication requirements of the role.  Clients should log in again
+	// with the returned acr_values and prompt=login.
+	ErrStepUpRequired = "step_up_required"
+	// ErrAccessDenied is STS refusing the role, e.g. because its trust
+	// policy does not match the identity.
+	ErrAccessDenied = "access_denied"
+	// ErrIdentityRejected is STS rejecting the ID token itself.
+	ErrIdentityRejected    = "identity_rejected"
+	ErrThrottled           = "throttled"
+	ErrIdPError            = "idp_error"
+	ErrSTSError            = "sts_error"
+	ErrProviderUnavailable = "provider_unavailable"
+	ErrNotFound            = "not_found"
+	ErrInternal            = "internal_error"
+)
+
+// defaultRetryAfter is the Retry-After hint for throttled requests when the
+// upstream service does not give one.
+const defaultRetryAfter = 5 * time.Second
+
+// apiError is an error with the status and code it is reported with.
+type apiError struct {
+	status     int
+	code       string
+	err        error
+	retryable  bool
+	retryAfter time.Duration
+	acrValues  []string
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// newAPIError returns an error reported with status and code.
+func newAPIError(status int, code string, err error) *apiError {
+	return &apiError{status: status, code: code, err: err}
+}
+
+// invalidRequest reports err as an invalid request.
+func invalidRequest(err error) *apiError {
+	return newAPIError(http.StatusBadRequest, ErrInvalidRequest, err)
+}
+
+// badRequest reports an invalid request with message.
+func badRequest(message string) *apiError {
+	return invalidRequest(errors.New(message))
+}
+
+// claimsRejected reports an ID token without the claims the server requires.
+func claimsRejected(err error) *apiError {
+	return newAPIError(http.StatusForbidden, ErrClaimsRejected, err)
+}
+
+// errorResponse renders err for the client.  Errors other than *apiError are
+// internal errors, which are logged rather than shown since they may reveal
+// details of the server.
+func errorResponse(req events.APIGatewayProxyRequest, err error) events.APIGatewayProxyResponse {
+	requestID := req.RequestContext.RequestID
+	message := err.Error()
+	var e *apiError
+	if !errors.As(err, &e) {
+		log.Printf("request %s: internal error: %v", requestID, err)
+		e = newAPIError(http.StatusInternalServerError, ErrInternal, err)
+		message = "internal error; see the server logs for request " + requestID
+	}
+	b, _ := json.Marshal(ErrorResponse{
+		Code:      e.code,
+		Message:   message,
+		RequestID: requestID,
+		Retryable: e.retryable,
+		ACRValues: strings.Join(e.acrValues, " "),
+	})
+	resp := events.APIGatewayProxyResponse{StatusCode: e.status,
+		Body:    string(b),
+		Headers: map[string]string{"Content-Type": "application/json"},
+	}
+	if e.retryAfter > 0 {
+		resp.Headers["Retry-After"] = retryAfter(e.retryAfter)
+	}
+	return resp
+}
+
+// stsError classifies an error from STS.
+func stsError(err error) *apiError {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		// The request did not get a response, e.g. a timeout
+		return &apiError{status: http.StatusBadGateway, code: ErrSTSError, err: err, retryable: true}
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied":
+		return newAPIError(http.StatusForbidden, ErrAccessDenied, err)
+	case "InvalidIdentityToken", "ExpiredTokenException", "IDPRejectedClaim":
+		return newAPIError(http.StatusUnauthorized, ErrIdentityRejected, err)
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return &apiError{status: http.StatusTooManyRequests, code: ErrThrottled, err: err,
+			retryable: true, retryAfter: defaultRetryAfter}
+	case "ValidationError", "MalformedPolicyDocument", "PackedPolicyTooLarge":
+		return newAPIError(http.StatusBadRequest, ErrInvalidRequest, err)
+	case "IDPCommunicationError":
+		return &apiError{status: http.StatusBadGateway, code: ErrIdPError, err: err, retryable: true}
+	}
+	return &apiError{status: http.StatusBadGateway, code: ErrSTSError, err: err,
+		retryable: apiErr.ErrorFault() == smithy.FaultServer}
+}
+
+// idpError classifies an error from the IdP's token endpoint.
+func idpError(err error) *apiError {
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) {
+		return &apiError{status: http.StatusBadGateway, code: ErrIdPError, err: err, retryable: true}
+	}
+	switch {
+	case re.ErrorCode == "invalid_grant":
+		return newAPIError(http.StatusBadRequest, ErrInvalidGrant, err)
+	case re.Response != nil && re.Response.StatusCode == http.StatusTooManyRequests:
+		e := &apiError{status: http.StatusTooManyRequests, code: ErrThrottled, err: err,
+			retryable: true, retryAfter: defaultRetryAfter}
+		if s, err := strconv.Atoi(re.Response.Header.Get("Retry-After")); err == nil && s > 0 {
+			e.retryAfter = time.Duration(s) * time.Second
+		}
+		return e
+	case re.ErrorCode == "temporarily_unavailable", re.ErrorCode == "server_error",
+		re.Response != nil && re.Response.StatusCode >= 500:
+		return &apiError{status: http.StatusBadGateway, code: ErrIdPError, err: err, retryable: true}
+	}
+	return newAPIError(http.StatusBadGateway, ErrIdPError, err)
+}
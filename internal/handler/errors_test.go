@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// errorBody decodes the ErrorResponse of resp.
+func errorBody(t *testing.T, resp events.APIGatewayProxyResponse) ErrorResponse {
+	t.Helper()
+	assert.Equal(t, "application/json", resp.Headers["Content-Type"])
+	var e ErrorResponse
+	require.NoError(t, json.Unmarshal([]byte(resp.Body), &e), resp.Body)
+	return e
+}
+
+func TestErrorResponse(t *testing.T) {
+	req := events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: "req-1"}}
+
+	resp := errorResponse(req, fmt.Errorf("failed to assume role: %w", stsError(&smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"})))
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "5", resp.Headers["Retry-After"])
+	assert.Equal(t, ErrorResponse{
+		Code:      ErrThrottled,
+		Message:   "failed to assume role: api error Throttling: Rate exceeded",
+		RequestID: "req-1",
+		Retryable: true,
+	}, errorBody(t, resp))
+
+	resp = errorResponse(req, errors.New("failed to read /var/task/secret"))
+	assert.Equal(t, 500, resp.StatusCode)
+	e := errorBody(t, resp)
+	assert.Equal(t, ErrInternal, e.Code)
+	assert.Equal(t, "req-1", e.RequestID)
+	assert.NotContains(t, e.Message, "/var/task")
+	assert.Contains(t, e.Message, "req-1")
+}
+
+func TestSTSError(t *testing.T) {
+	cases := []struct {
+		err       error
+		status    int
+		code      string
+		retryable bool
+	}{
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, 403, ErrAccessDenied, false},
+		{&smithy.GenericAPIError{Code: "InvalidIdentityToken"}, 401, ErrIdentityRejected, false},
+		{&smithy.GenericAPIError{Code: "ExpiredTokenException"}, 401, ErrIdentityRejected, false},
+		{&smithy.GenericAPIError{Code: "RequestLimitExceeded"}, 429, ErrThrottled, true},
+		{&smithy.GenericAPIError{Code: "MalformedPolicyDocument"}, 400, ErrInvalidRequest, false},
+		{&smithy.GenericAPIError{Code: "IDPCommunicationError"}, 502, ErrIdPError, true},
+		{&smithy.GenericAPIError{Code: "InternalFailure", Fault: smithy.FaultServer}, 502, ErrSTSError, true},
+		{&smithy.GenericAPIError{Code: "RegionDisabledException", Fault: smithy.FaultClient}, 502, ErrSTSError, false},
+		{errors.New("connection reset"), 502, ErrSTSError, true},
+	}
+	for _, c := range cases {
+		t.Run(c.err.Error(), func(t *testing.T) {
+			e := stsError(fmt.Errorf("failed to assume hub role: %w", c.err))
+			assert.Equal(t, c.status, e.status)
+			assert.Equal(t, c.code, e.code)
+			assert.Equal(t, c.retryable, e.retryable)
+		})
+	}
+}
+
+func TestIdPError(t *testing.T) {
+	retrieveError := func(status int, code string, header http.Header) error {
+		return &oauth2.RetrieveError{Response: &http.Response{StatusCode: status, Header: header}, ErrorCode: code}
+	}
+	cases := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		retryable  bool
+		retryAfter string
+	}{
+		{"invalid_grant", retrieveError(400, "invalid_grant", nil), 400, ErrInvalidGrant, false, ""},
+		{"invalid_client", retrieveError(401, "invalid_client", nil), 502, ErrIdPError, false, ""},
+		{"server error", retrieveError(503, "", nil), 502, ErrIdPError, true, ""},
+		{"temporarily unavailable", retrieveError(400, "temporarily_unavailable", nil), 502, ErrIdPError, true, ""},
+		{"throttled", retrieveError(429, "", http.Header{"Retry-After": {"30"}}), 429, ErrThrottled, true, "30"},
+		{"throttled without hint", retrieveError(429, "", nil), 429, ErrThrottled, true, "5"},
+		{"transport", errors.New("dial tcp: timeout"), 502, ErrIdPError, true, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := errorResponse(events.APIGatewayProxyRequest{}, idpError(c.err))
+			assert.Equal(t, c.status, resp.StatusCode)
+			assert.Equal(t, c.retryAfter, resp.Headers["Retry-After"])
+			e := errorBody(t, resp)
+			assert.Equal(t, c.code, e.Code)
+			assert.Equal(t, c.retryable, e.Retryable)
+		})
+	}
+}
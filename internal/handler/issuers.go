@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// IssuerConfig is the configuration of a named issuer.  Besides the OIDC
+// client, it may override the claim mappings and policy of the base Config;
+// empty fields inherit them.
+type IssuerConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// ClientKey holds PEM-encoded private keys for private_key_jwt client
+	// authentication, used instead of ClientSecret.
+	ClientKey string   `json:"client_key,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+
+	SessionNameTemplate string       `json:"session_name_template,omitempty"`
+	SourceIdentityClaim string       `json:"source_identity_claim,omitempty"`
+	SessionTags         []SessionTag `json:"session_tags,omitempty"`
+	Rules               []RoleRule   `json:"role_rules,omitempty"`
+	HubRoleARN          string       `json:"hub_role_arn,omitempty"`
+	ExternalID          string       `json:"external_id,omitempty"`
+	AllowedPrompts      []string     `json:"allowed_prompts,omitempty"`
+	AllowedACRValues    []string     `json:"allowed_acr_values,omitempty"`
+	AllowedScopes       []string     `json:"allowed_scopes,omitempty"`
+}
+
+// Config returns base with the issuer's overrides applied.
+func (ic IssuerConfig) Config(base Config) Config {
+	c := base
+	if ic.SessionNameTemplate != "" {
+		c.SessionNameTemplate = ic.SessionNameTemplate
+	}
+	if ic.SourceIdentityClaim != "" {
+		c.SourceIdentityClaim = ic.SourceIdentityClaim
+	}
+	if ic.SessionTags != nil {
+		c.SessionTags = ic.SessionTags
+	}
+	if ic.Rules != nil {
+		c.Rules = ic.Rules
+	}
+	if ic.HubRoleARN != "" {
+		c.HubRoleARN = ic.HubRoleARN
+	}
+	if ic.ExternalID != "" {
+		c.ExternalID = ic.ExternalID
+	}
+	if ic.AllowedPrompts != nil {
+		c.AllowedPrompts = ic.AllowedPrompts
+	}
+	if ic.AllowedACRValues != nil {
+		c.AllowedACRValues = ic.AllowedACRValues
+	}
+	if ic.AllowedScopes != nil {
+		c.AllowedScopes = ic.AllowedScopes
+	}
+	return c
+}
+
+// IssuerFunc builds the handler for an issuer, which usually involves OIDC
+// discovery.  It is called on the first request for the issuer, retried with
+// backoff until it succeeds, and called again every RefreshInterval.
+type IssuerFunc func(ctx context.Context) (*AwsCredsHandler, error)
+
+// Backoff between attempts to initialize an issuer that failed.
+const (
+	minIssuerRetryDelay = time.Second
+	maxIssuerRetryDelay = time.Minute
+)
+
+// issuerName restricts names to what can appear as a path segment.
+var issuerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Issuers routes requests to one of several named issuers.  A request selects
+// the issuer with a path prefix, e.g. /<name>/auth, or with the provider
+// parameter; requests that do neither go to Default.  Issuers are
+// initialized lazily, so that one that is unavailable does not affect the
+// others.  While an issuer is unavailable, its requests fail with 503 and a
+// Retry-After hint.
+type Issuers struct {
+	// Default names the issuer for requests that do not select one.
+	Default string
+
+	// RefreshInterval, if set, rebuilds initialized issuers on the first
+	// request after it elapses, picking up changes to the provider's
+	// discovery document.  If that fails, the previous handler is kept.
+	RefreshInterval time.Duration
+
+	now     func() time.Time
+	issuers map[string]*lazyIssuer
+}
+
+// lazyIssuer initializes an issuer's handler on first use.
+type lazyIssuer struct {
+	init IssuerFunc
+
+	mu          sync.Mutex
+	h           *AwsCredsHandler
+	initialized time.Time
+	// failures counts consecutive failed attempts; none are made before retryAt.
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+// unavailableError reports an issuer that could not be initialized.
+type unavailableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// NewIssuers returns an empty set of issuers.
+func NewIssuers() *Issuers {
+	return &Issuers{now: time.Now, issuers: map[string]*lazyIssuer{}}
+}
+
+// Add registers a named issuer.
+func (m *Issuers) Add(name string, init IssuerFunc) error {
+	if !issuerName.MatchString(name) || name == "auth" || name == "creds" || name == "jwks" {
+		return fmt.Errorf("invalid issuer name %q", name)
+	}
+	if _, ok := m.issuers[name]; ok {
+		return fmt.Errorf("duplicate issuer %q", name)
+	}
+	m.issuers[name] = &lazyIssuer{init: init}
+	return nil
+}
+
+// get returns the issuer's handler, initializing or refreshing it if
+// necessary.  Failed attempts are retried with exponential backoff; until an
+// attempt succeeds, get returns an *unavailableError, or the previous
+// handler if there is one.
+func (l *lazyIssuer) get(ctx context.Context, now time.Time, refresh time.Duration) (*AwsCredsHandler, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h != nil && (refresh == 0 || now.Sub(l.initialized) < refresh) {
+		return l.h, nil
+	}
+	if now.Before(l.retryAt) {
+		if l.h != nil {
+			return l.h, nil
+		}
+		return nil, &unavailableError{err: l.err, retryAfter: l.retryAt.Sub(now)}
+	}
+	h, err := l.init(ctx)
+	if err != nil {
+		delay := min(minIssuerRetryDelay<<min(l.failures, 16), maxIssuerRetryDelay)
+		l.failures++
+		l.retryAt = now.Add(delay)
+		l.err = err
+		if l.h != nil {
+			log.Printf("failed to refresh issuer, keeping previous configuration: %v", err)
+			return l.h, nil
+		}
+		return nil, &unavailableError{err: err, retryAfter: delay}
+	}
+	l.h, l.initialized = h, now
+	l.failures, l.retryAt, l.err = 0, time.Time{}, nil
+	return h, nil
+}
+
+// Serve routes API Gateway requests to the selected issuer's handler.
+func (m *Issuers) Serve(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	name, endpoint := splitIssuerPath(req.Path)
+	if endpoint != "/auth" && endpoint != "/creds" && endpoint != "/jwks" {
+		return errorResponse(req, newAPIError(http.StatusNotFound, ErrNotFound, errors.New("not found"))), nil
+	}
+	param := req.QueryStringParameters["provider"]
+	if param == "" && endpoint == "/creds" {
+		var body struct {
+			Provider string `json:"provider"`
+		}
+		_ = json.Unmarshal([]byte(req.Body), &body) // HandleCreds reports invalid bodies
+		param = body.Provider
+	}
+	switch {
+	case name == "":
+		name = param
+	case param != "" && param != name:
+		return errorResponse(req, badRequest("provider does not match path")), nil
+	}
+	if name == "" {
+		name = m.Default
+	}
+	if name == "" {
+		return errorResponse(req, badRequest("missing provider")), nil
+	}
+	issuer, ok := m.issuers[name]
+	if !ok {
+		return errorResponse(req, newAPIError(http.StatusNotFound, ErrNotFound, fmt.Errorf("unknown provider %q", name))), nil
+	}
+	h, err := issuer.get(ctx, m.now(), m.RefreshInterval)
+	if err != nil {
+		log.Printf("issuer %s: %v", name, err)
+		e := &apiError{status: http.StatusServiceUnavailable, code: ErrProviderUnavailable,
+			err: fmt.Errorf("provider %q unavailable", name), retryable: true}
+		var unavailable *unavailableError
+		if errors.As(err, &unavailable) {
+			e.retryAfter = unavailable.retryAfter
+		}
+		return errorResponse(req, e), nil
+	}
+	switch endpoint {
+	case "/auth":
+		return h.HandleAuth(ctx, req)
+	case "/jwks":
+		return h.HandleJWKS(ctx, req)
+	}
+	return h.HandleCreds(ctx, req)
+}
+
+// splitIssuerPath splits /<name>/<endpoint> into the issuer name and
+// /<endpoint>.  Paths without a prefix return an empty name.
+func splitIssuerPath(path string) (name, endpoint string) {
+	rest, ok := strings.CutPrefix(path, "/")
+	if !ok {
+		return "", path
+	}
+	name, endpoint, ok = strings.Cut(rest, "/")
+	if !ok {
+		return "", path
+	}
+	return name, "/" + endpoint
+}
+
+// retryAfter formats d as a Retry-After value in whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(max(d+time.Second-1, time.Second) / time.Second))
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIssuers returns issuers "a" (the default) and "b" backed by test
+// handlers sharing a state key.
+func newTestIssuers() *Issuers {
+	m := NewIssuers()
+	m.Default = "a"
+	for _, name := range []string{"a", "b"} {
+		_ = m.Add(name, func(context.Context) (*AwsCredsHandler, error) {
+			h := newTestHandler(nil, nil, nil)
+			h.Config.Provider = name
+			return h, nil
+		})
+	}
+	return m
+}
+
+func TestIssuers_Route(t *testing.T) {
+	cases := []struct {
+		name     string
+		path     string
+		provider string
+		status   int
+		want     string
+	}{
+		{"default", "/auth", "", 302, "a"},
+		{"path prefix", "/b/auth", "", 302, "b"},
+		{"parameter", "/auth", "b", 302, "b"},
+		{"matching parameter", "/b/auth", "b", 302, "b"},
+		{"mismatched parameter", "/b/auth", "a", 400, ""},
+		{"unknown", "/c/auth", "", 404, ""},
+		{"unknown endpoint", "/b/other", "", 404, ""},
+		{"nested path", "/a/b/auth", "", 404, ""},
+	}
+	m := newTestIssuers()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := map[string]string{
+				"state":        "s",
+				"challenge":    "c",
+				"redirect_uri": testRedirectURI,
+				"nonce":        "n",
+			}
+			if c.provider != "" {
+				params["provider"] = c.provider
+			}
+			resp, _ := m.Serve(context.Background(), events.APIGatewayProxyRequest{Path: c.path, QueryStringParameters: params})
+			require.Equal(t, c.status, resp.StatusCode, resp.Body)
+			if c.status != 302 {
+				return
+			}
+			loc, err := url.Parse(resp.Headers["Location"])
+			require.NoError(t, err)
+			claims, err := ParseStateUnverified(loc.Query().Get("state"))
+			require.NoError(t, err)
+			assert.Equal(t, c.want, claims.Provider)
+		})
+	}
+
+	t.Run("no default", func(t *testing.T) {
+		m := newTestIssuers()
+		m.Default = ""
+		resp, _ := m.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/auth"})
+		assert.Equal(t, 400, resp.StatusCode)
+		assert.Contains(t, resp.Body, "missing provider")
+	})
+}
+
+func TestIssuers_CredsProvider(t *testing.T) {
+	m := newTestIssuers()
+	a, err := m.issuers["a"].get(context.Background(), time.Now(), 0)
+	require.NoError(t, err)
+	b := CredsRequest{
+		Code:          "c",
+		Verifier:      "v",
+		Account:       "123456789012",
+		Role:          "r",
+		RedirectURI:   testRedirectURI,
+		EncryptionKey: testEncryptionJWK(),
+		Provider:      "b",
+	}
+	b.State = signTestState(t, a, b)
+	data, _ := json.Marshal(b)
+
+	// The provider in the body selects b, which rejects a's state
+	resp, _ := m.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/creds", Body: string(data)})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "provider mismatch")
+
+	resp, _ = m.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/a/creds", Body: string(data)})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "provider does not match path")
+}
+
+func TestIssuers_LazyInit(t *testing.T) {
+	m := NewIssuers()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	calls := 0
+	var initErr error = errors.New("discovery failed")
+	require.NoError(t, m.Add("flaky", func(context.Context) (*AwsCredsHandler, error) {
+		calls++
+		if initErr != nil {
+			return nil, initErr
+		}
+		return newTestHandler(nil, nil, nil), nil
+	}))
+	require.NoError(t, m.Add("ok", func(context.Context) (*AwsCredsHandler, error) {
+		return newTestHandler(nil, nil, nil), nil
+	}))
+	assert.Zero(t, calls)
+
+	ctx := context.Background()
+	serve := func(path string) events.APIGatewayProxyResponse {
+		resp, _ := m.Serve(ctx, events.APIGatewayProxyRequest{Path: path})
+		return resp
+	}
+	resp := serve("/flaky/auth")
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "1", resp.Headers["Retry-After"])
+	e := errorBody(t, resp)
+	assert.Equal(t, ErrProviderUnavailable, e.Code)
+	assert.True(t, e.Retryable)
+	assert.Equal(t, 400, serve("/ok/auth").StatusCode, "other issuers are unaffected")
+
+	// Attempts back off exponentially
+	now = now.Add(time.Second)
+	resp = serve("/flaky/auth")
+	assert.Equal(t, "2", resp.Headers["Retry-After"])
+	now = now.Add(time.Second)
+	resp = serve("/flaky/auth")
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "1", resp.Headers["Retry-After"], "remaining delay")
+	assert.Equal(t, 2, calls, "no attempt during backoff")
+
+	initErr = nil
+	now = now.Add(time.Second)
+	for range 2 {
+		assert.Equal(t, 400, serve("/flaky/auth").StatusCode)
+	}
+	assert.Equal(t, 3, calls, "initialized once after success")
+}
+
+func TestIssuers_Refresh(t *testing.T) {
+	m := NewIssuers()
+	m.RefreshInterval = time.Hour
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	var built []*AwsCredsHandler
+	var initErr error
+	require.NoError(t, m.Add("a", func(context.Context) (*AwsCredsHandler, error) {
+		if initErr != nil {
+			return nil, initErr
+		}
+		h := newTestHandler(nil, nil, nil)
+		built = append(built, h)
+		return h, nil
+	}))
+	l := m.issuers["a"]
+	get := func() *AwsCredsHandler {
+		h, err := l.get(context.Background(), now, m.RefreshInterval)
+		require.NoError(t, err)
+		return h
+	}
+
+	first := get()
+	now = now.Add(30 * time.Minute)
+	assert.Same(t, first, get(), "cached")
+
+	now = now.Add(time.Hour)
+	second := get()
+	assert.NotSame(t, first, second, "refreshed")
+
+	initErr = errors.New("discovery failed")
+	now = now.Add(2 * time.Hour)
+	assert.Same(t, second, get(), "previous handler kept on refresh failure")
+	assert.Len(t, built, 2)
+}
+
+func TestIssuers_Add(t *testing.T) {
+	m := NewIssuers()
+	init := func(context.Context) (*AwsCredsHandler, error) { return nil, nil }
+	assert.NoError(t, m.Add("contractors", init))
+	assert.ErrorContains(t, m.Add("contractors", init), "duplicate")
+	for _, name := range []string{"", "a/b", "auth", "creds", "jwks"} {
+		assert.Error(t, m.Add(name, init), name)
+	}
+}
+
+func TestIssuerConfig_Config(t *testing.T) {
+	base := Config{SessionNameTemplate: "{{.email}}", HubRoleARN: "arn:aws:iam::1:role/hub", Rules: []RoleRule{{Role: "*"}}}
+	got := IssuerConfig{SessionNameTemplate: "{{.sub}}", Rules: []RoleRule{}}.Config(base)
+	assert.Equal(t, "{{.sub}}", got.SessionNameTemplate)
+	assert.Equal(t, base.HubRoleARN, got.HubRoleARN)
+	assert.Empty(t, got.Rules)
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+)
+
+// jwksCacheControl lets the IdP cache the key set briefly.  Rotated keys
+// must be published for at least this long before they are used.
+const jwksCacheControl = "public, max-age=300"
+
+// HandleJWKS serves the public keys of the client's private_key_jwt keys,
+// for IdPs that fetch them from a jwks_uri.
+func (h *AwsCredsHandler) HandleJWKS(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.Config.ClientKeys == nil {
+		return errorResponse(req, newAPIError(http.StatusNotFound, ErrNotFound, errors.New("no client keys configured"))), nil
+	}
+	keys, err := h.Config.ClientKeys(ctx)
+	if err != nil {
+		log.Printf("failed to load client keys: %v", err)
+		return errorResponse(req, errors.New("failed to load client keys")), nil
+	}
+	b, err := json.Marshal(oidc.PublicJWKS(keys))
+	if err != nil {
+		return errorResponse(req, errors.New("failed to encode keys")), nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: 200,
+		Body: string(b),
+		Headers: map[string]string{
+			"Content-Type":  "application/jwk-set+json",
+			"Cache-Control": jwksCacheControl,
+		},
+	}, nil
+}
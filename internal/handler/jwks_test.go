@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys := []oidc.SigningKey{{KeyID: "new", Key: key}, {KeyID: "old", Key: key}}
+
+	h := newTestHandler(nil, nil, nil)
+	resp, _ := h.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/jwks"})
+	assert.Equal(t, 404, resp.StatusCode, "no client keys configured")
+
+	h.Config.ClientKeys = func(context.Context) ([]oidc.SigningKey, error) { return keys, nil }
+	resp, _ = h.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/jwks"})
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/jwk-set+json", resp.Headers["Content-Type"])
+	assert.NotEmpty(t, resp.Headers["Cache-Control"])
+	var set oidc.JWKS
+	require.NoError(t, json.Unmarshal([]byte(resp.Body), &set))
+	require.Len(t, set.Keys, 2)
+	assert.Equal(t, "new", set.Keys[0].Kid)
+	assert.Equal(t, "old", set.Keys[1].Kid)
+	assert.NotContains(t, resp.Body, `"d"`, "no private key material")
+
+	h.Config.ClientKeys = func(context.Context) ([]oidc.SigningKey, error) { return nil, errors.New("unavailable") }
+	resp, _ = h.Serve(context.Background(), events.APIGatewayProxyRequest{Path: "/jwks"})
+	assert.Equal(t, 500, resp.StatusCode)
+}
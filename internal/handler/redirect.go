@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// loopbackCallbackPath is the path the CLI listens on for the OIDC redirect.
+const loopbackCallbackPath = "/creds"
+
+var errInvalidRedirectURI = errors.New("invalid redirect_uri")
+
+// validateRedirectURI accepts only the CLI's loopback callback, or an exact
+// match from the configured allowlist.
+//
+// The loopback check is deliberately strict: the URI is parsed, rebuilt in
+// canonical form, and compared byte for byte with the input.  Anything that
+// does not round-trip (userinfo, percent-encoded or alternative IP notations,
+// trailing dots, queries, fragments, ...) is rejected.
+func validateRedirectURI(redirectURI string, allowlist []string) error {
+	if slices.Contains(allowlist, redirectURI) {
+		return nil
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return errInvalidRedirectURI
+	}
+	if u.Scheme != "http" || u.User != nil || u.Opaque != "" {
+		return errInvalidRedirectURI
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return errInvalidRedirectURI
+	}
+	if host != "127.0.0.1" && host != "::1" {
+		return errInvalidRedirectURI
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errInvalidRedirectURI
+	}
+	canonical := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(n)),
+		Path:   loopbackCallbackPath,
+	}
+	if canonical.String() != redirectURI {
+		return errInvalidRedirectURI
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+)
+
+// RoleRule holds server-side policy for requests whose account and role
+// match.  Rules are evaluated in order; the first match applies.
+type RoleRule struct {
+	// Account and Role are path.Match patterns, e.g. "123456789012" or
+	// "*-admin".  Empty matches everything.  Role is matched against the
+	// role name both with and without its path.
+	Account string `json:"account,omitempty"`
+	Role    string `json:"role,omitempty"`
+
+	// SessionPolicy is an inline session policy applied to every session for
+	// matching roles.
+	SessionPolicy json.RawMessage `json:"session_policy,omitempty"`
+	// PolicyARNs are managed session policies applied to every session for
+	// matching roles.
+	PolicyARNs []string `json:"policy_arns,omitempty"`
+
+	// MaxDuration caps the session duration, in seconds, for matching roles.
+	// It should not exceed the role's MaxSessionDuration.
+	MaxDuration int32 `json:"max_duration,omitempty"`
+
+	// ExternalID overrides Config.ExternalID for matching roles.
+	ExternalID string `json:"external_id,omitempty"`
+
+	// ACRValues, if set, requires the ID token's acr claim to be one of
+	// them, e.g. "phrh" for phishing-resistant hardware MFA.
+	ACRValues []string `json:"acr_values,omitempty"`
+	// AMR requires the ID token's amr claim to contain all of these
+	// methods, e.g. "hwk".
+	AMR []string `json:"amr,omitempty"`
+}
+
+// matches reports whether the rule applies to account and role.  As "*"
+// does not match "/", "*-admin" would otherwise miss "team/prod-admin".
+func (r RoleRule) matches(account, role string) bool {
+	return matchPattern(r.Account, account) &&
+		(matchPattern(r.Role, role) || matchPattern(r.Role, path.Base(role)))
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+var (
+	accountPattern = regexp.MustCompile(`^\d{12}$`)
+	// rolePattern is an IAM role name, optionally preceded by its path.
+	rolePattern = regexp.MustCompile(`^([\w+=,.@-]+/)*[\w+=,.@-]{1,64}$`)
+)
+
+// validateRole checks that account and role name a valid role ARN, so that
+// rules are matched against the role STS will assume.
+func validateRole(account, role string) error {
+	if !accountPattern.MatchString(account) {
+		return fmt.Errorf("invalid account ID %q", account)
+	}
+	if !rolePattern.MatchString(role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	return nil
+}
+
+// hasSessionPolicies reports whether the rule mandates session policies.
+func (r RoleRule) hasSessionPolicies() bool {
+	return len(r.SessionPolicy) > 0 || len(r.PolicyARNs) > 0
+}
+
+// ruleFor returns the first rule matching account and role, or nil.
+func (c Config) ruleFor(account, role string) *RoleRule {
+	for i := range c.Rules {
+		if c.Rules[i].matches(account, role) {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// STS limits for session policies.
+const (
+	maxSessionPolicyLen = 2048
+	maxPolicyARNs       = 10
+)
+
+var policyARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(\d{12}|aws):policy/[\w+=,.@/-]+$`)
+
+// sessionPolicies holds the session policies to pass to STS.
+type sessionPolicies struct {
+	Policy     string
+	PolicyARNs []string
+}
+
+// resolveSessionPolicies combines caller-requested session policies with
+// those mandated by rule.  STS grants the union of all session policies, so a
+// caller policy next to a mandated one could widen access beyond what the
+// rule allows; such requests are rejected.
+func resolveSessionPolicies(rule *RoleRule, policy string, policyARNs []string) (sessionPolicies, error) {
+	requested := policy != "" || len(policyARNs) > 0
+	if rule != nil && rule.hasSessionPolicies() {
+		if requested {
+			return sessionPolicies{}, errors.New("role has mandatory session policies; caller session policies are not allowed")
+		}
+		policy, policyARNs = string(rule.SessionPolicy), rule.PolicyARNs
+	}
+	if policy != "" {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(policy)); err != nil {
+			return sessionPolicies{}, fmt.Errorf("invalid session policy: %w", err)
+		}
+		if compact.Len() > maxSessionPolicyLen {
+			return sessionPolicies{}, fmt.Errorf("invalid session policy: longer than %d characters", maxSessionPolicyLen)
+		}
+		policy = compact.String()
+	}
+	if len(policyARNs) > maxPolicyARNs {
+		return sessionPolicies{}, fmt.Errorf("too many policy ARNs (max %d)", maxPolicyARNs)
+	}
+	for _, arn := range policyARNs {
+		if !policyARNPattern.MatchString(arn) {
+			return sessionPolicies{}, fmt.Errorf("invalid policy ARN %q", arn)
+		}
+	}
+	return sessionPolicies{Policy: policy, PolicyARNs: policyARNs}, nil
+}
+
+// STS limits for session durations.
+const (
+	minSessionDuration = 15 * time.Minute
+	maxSessionDuration = 12 * time.Hour
+)
+
+// fallbackSessionDurations are tried in turn when STS rejects a duration as
+// longer than the role's MaxSessionDuration, which STS does not report.  The
+// last is an hour, which every role allows; keeping the list short bounds
+// the number of STS calls per request.
+var fallbackSessionDurations = []time.Duration{4 * time.Hour, time.Hour}
+
+// defaultSessionDuration must be > 15 minutes, otherwise awscli will attempt
+// to immediately refresh the token.
+const defaultSessionDuration = 30 * time.Minute
+
+// sessionDuration returns the duration to request from STS: the caller's
+// request, or the default, capped by rule.
+func sessionDuration(rule *RoleRule, requested int32) (time.Duration, error) {
+	d := defaultSessionDuration
+	if requested != 0 {
+		d = time.Duration(requested) * time.Second
+		if d < minSessionDuration || d > maxSessionDuration {
+			return 0, fmt.Errorf("invalid duration: must be between %d and %d seconds",
+				int(minSessionDuration.Seconds()), int(maxSessionDuration.Seconds()))
+		}
+	}
+	if rule != nil && rule.MaxDuration != 0 {
+		d = min(d, time.Duration(rule.MaxDuration)*time.Second)
+	}
+	return d, nil
+}
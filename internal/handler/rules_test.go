@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+	"github.com/michaelw/aws-oidc-cli/internal/audit"
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+const readOnlyPolicy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:Get*", "Resource": "*"}]}`
+
+func TestRuleFor(t *testing.T) {
+	cfg := Config{Rules: []RoleRule{
+		{Account: "111111111111", Role: "*-admin", PolicyARNs: []string{"first"}},
+		{Role: "*-admin", PolicyARNs: []string{"second"}},
+		{Account: "[", PolicyARNs: []string{"malformed"}},
+	}}
+	assert.Equal(t, "first", cfg.ruleFor("111111111111", "prod-admin").PolicyARNs[0])
+	assert.Equal(t, "second", cfg.ruleFor("222222222222", "prod-admin").PolicyARNs[0])
+	assert.Equal(t, "second", cfg.ruleFor("222222222222", "team/prod-admin").PolicyARNs[0], "role path")
+	assert.Nil(t, cfg.ruleFor("222222222222", "readonly"))
+	assert.Nil(t, Config{}.ruleFor("a", "r"))
+}
+
+func TestValidateRole(t *testing.T) {
+	assert.NoError(t, validateRole("123456789012", "prod-admin"))
+	assert.NoError(t, validateRole("123456789012", "team/prod-admin"))
+	assert.NoError(t, validateRole("123456789012", "svc+role=a,b.c@d_e"))
+	for _, c := range [][2]string{
+		{"12345678901", "r"},
+		{"1234567890123", "r"},
+		{"12345678901a", "r"},
+		{"123456789012", "/r"},
+		{"123456789012", "team/"},
+		{"123456789012", "team//r"},
+		{"123456789012", "prod-*"},
+		{"123456789012", strings.Repeat("r", 65)},
+	} {
+		assert.Error(t, validateRole(c[0], c[1]), "%q %q", c[0], c[1])
+	}
+}
+
+func TestResolveSessionPolicies(t *testing.T) {
+	mandatory := &RoleRule{SessionPolicy: json.RawMessage(readOnlyPolicy)}
+	arn := "arn:aws:iam::aws:policy/ReadOnlyAccess"
+
+	got, err := resolveSessionPolicies(nil, readOnlyPolicy, []string{arn})
+	require.NoError(t, err)
+	assert.NotContains(t, got.Policy, " ")
+	assert.Equal(t, []string{arn}, got.PolicyARNs)
+
+	got, err = resolveSessionPolicies(mandatory, "", nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, readOnlyPolicy, got.Policy)
+
+	got, err = resolveSessionPolicies(&RoleRule{Role: "x"}, "", []string{arn})
+	require.NoError(t, err)
+	assert.Equal(t, []string{arn}, got.PolicyARNs)
+
+	_, err = resolveSessionPolicies(mandatory, "", []string{arn})
+	assert.ErrorContains(t, err, "mandatory session policies")
+	_, err = resolveSessionPolicies(nil, "{not json", nil)
+	assert.ErrorContains(t, err, "invalid session policy")
+	_, err = resolveSessionPolicies(nil, `{"x":"`+strings.Repeat("a", maxSessionPolicyLen)+`"}`, nil)
+	assert.ErrorContains(t, err, "longer than")
+	_, err = resolveSessionPolicies(nil, "", []string{"arn:aws:iam::123:policy/x"})
+	assert.ErrorContains(t, err, "invalid policy ARN")
+	_, err = resolveSessionPolicies(nil, "", make([]string, maxPolicyARNs+1))
+	assert.ErrorContains(t, err, "too many policy ARNs")
+}
+
+func TestHandleCreds_SessionPolicies(t *testing.T) {
+	arn := "arn:aws:iam::123456789012:policy/team/ReadOnly"
+	cases := []struct {
+		name       string
+		rules      []RoleRule
+		policy     string
+		policyARNs []string
+		status     int
+		wantPolicy string
+		wantARNs   []string
+	}{
+		{"caller policies", nil, readOnlyPolicy, []string{arn}, 200, readOnlyPolicy, []string{arn}},
+		{"no policies", nil, "", nil, 200, "", nil},
+		{"mandatory policy", []RoleRule{{Role: "r", SessionPolicy: json.RawMessage(readOnlyPolicy)}}, "", nil, 200, readOnlyPolicy, nil},
+		{"mandatory policy for other role", []RoleRule{{Role: "other", PolicyARNs: []string{arn}}}, "", nil, 200, "", nil},
+		{"caller policy with mandatory policy", []RoleRule{{Role: "r", PolicyARNs: []string{arn}}}, readOnlyPolicy, nil, 400, "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+			h := newTestHandler(nil, tok, nil)
+			h.Config.Rules = c.rules
+			var got *awsutils.WebIdentityInput
+			sts := h.STSClient.(*awsutils.MockSTSClient)
+			next := sts.AssumeRoleWithWebIdentityFunc
+			sts.AssumeRoleWithWebIdentityFunc = func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
+				got = in
+				return next(ctx, in)
+			}
+			exchanged := false
+			idp := h.OIDCClient.(*oidc.MockOIDCClient)
+			idp.ExchangeCodeFunc = func(context.Context, string, string, string) (*oauth2.Token, error) {
+				exchanged = true
+				return tok, nil
+			}
+
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+				Policy:        c.policy,
+				PolicyARNs:    c.policyARNs,
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode, resp.Body)
+			if c.status != 200 {
+				assert.Nil(t, got)
+				assert.False(t, exchanged)
+				return
+			}
+			require.NotNil(t, got)
+			if c.wantPolicy == "" {
+				assert.Empty(t, got.Policy)
+			} else {
+				assert.JSONEq(t, c.wantPolicy, got.Policy)
+			}
+			assert.Equal(t, c.wantARNs, got.PolicyARNs)
+		})
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	admin := &RoleRule{MaxDuration: 900}
+	cases := []struct {
+		name      string
+		rule      *RoleRule
+		requested int32
+		want      time.Duration
+		wantErr   bool
+	}{
+		{"default", nil, 0, 30 * time.Minute, false},
+		{"requested", nil, 12 * 3600, 12 * time.Hour, false},
+		{"default capped", admin, 0, 15 * time.Minute, false},
+		{"requested capped", admin, 3600, 15 * time.Minute, false},
+		{"rule without cap", &RoleRule{Role: "x"}, 7200, 2 * time.Hour, false},
+		{"too short", nil, 60, 0, true},
+		{"too long", nil, 12*3600 + 1, 0, true},
+		{"negative", nil, -1, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := sessionDuration(c.rule, c.requested)
+			if c.wantErr {
+				assert.ErrorContains(t, err, "invalid duration")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestConfigValidate_Rules(t *testing.T) {
+	assert.NoError(t, Config{Rules: []RoleRule{{Role: "*-admin", MaxDuration: 900}}}.Validate())
+	assert.ErrorContains(t, Config{Rules: []RoleRule{{MaxDuration: 60}}}.Validate(), "rule 0: invalid max_duration")
+	assert.ErrorContains(t, Config{Rules: []RoleRule{{}, {PolicyARNs: []string{"nope"}}}}.Validate(), "rule 1: invalid policy ARN")
+}
+
+func TestHandleCreds_Duration(t *testing.T) {
+	tooLong := &smithy.GenericAPIError{
+		Code:    "ValidationError",
+		Message: "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.",
+	}
+	cases := []struct {
+		name      string
+		rules     []RoleRule
+		requested int32
+		roleMax   int32
+		status    int
+		want      []int32
+	}{
+		{"default", nil, 0, 3600, 200, []int32{1800}},
+		{"requested", nil, 8 * 3600, 12 * 3600, 200, []int32{8 * 3600}},
+		{"capped by rule", []RoleRule{{Role: "r", MaxDuration: 900}}, 8 * 3600, 3600, 200, []int32{900}},
+		{"retried down to an hour", nil, 8 * 3600, 3600, 200, []int32{8 * 3600, 4 * 3600, 3600}},
+		{"retried at role limit", nil, 12 * 3600, 4 * 3600, 200, []int32{12 * 3600, 4 * 3600}},
+		{"stepped down below role limit", nil, 8 * 3600, 3 * 3600, 200, []int32{8 * 3600, 4 * 3600, 3600}},
+		{"retried from two hours", nil, 2 * 3600, 3600, 200, []int32{2 * 3600, 3600}},
+		{"no retry within an hour", nil, 3000, 2000, 400, []int32{3000}},
+		{"invalid", nil, 60, 3600, 400, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var ev audit.Event
+			tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+			h := newTestHandler(nil, tok, nil)
+			h.Config.Rules = c.rules
+			h.Config.Audit = audit.SinkFunc(func(ctx context.Context, e audit.Event) error {
+				ev = e
+				return nil
+			})
+			var got []int32
+			sts := h.STSClient.(*awsutils.MockSTSClient)
+			next := sts.AssumeRoleWithWebIdentityFunc
+			sts.AssumeRoleWithWebIdentityFunc = func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
+				got = append(got, in.DurationSeconds)
+				if in.DurationSeconds > c.roleMax {
+					return nil, tooLong
+				}
+				return next(ctx, in)
+			}
+
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+				Duration:      c.requested,
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode, resp.Body)
+			assert.Equal(t, c.want, got)
+			if c.status == 200 {
+				assert.Equal(t, got[0], ev.RequestedDuration)
+				assert.Equal(t, got[len(got)-1], ev.GrantedDuration)
+			}
+		})
+	}
+}
+
+func TestHandleCreds_RoleValidation(t *testing.T) {
+	arn := "arn:aws:iam::123456789012:policy/team/ReadOnly"
+	cases := []struct {
+		name     string
+		account  string
+		role     string
+		status   int
+		wantARNs []string
+	}{
+		{"pathed role matches rule", "123456789012", "team/prod-admin", 200, []string{arn}},
+		{"invalid account", "1234567890", "prod-admin", 400, nil},
+		{"wildcard role", "123456789012", "*-admin", 400, nil},
+		{"role with empty path segment", "123456789012", "team//prod-admin", 400, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": createTestJWT(t, "foo@bar.com")})
+			h := newTestHandler(nil, tok, nil)
+			h.Config.Rules = []RoleRule{{Role: "*-admin", PolicyARNs: []string{arn}}}
+			var got *awsutils.WebIdentityInput
+			sts := h.STSClient.(*awsutils.MockSTSClient)
+			next := sts.AssumeRoleWithWebIdentityFunc
+			sts.AssumeRoleWithWebIdentityFunc = func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
+				got = in
+				return next(ctx, in)
+			}
+
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       c.account,
+				Role:          c.role,
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode, resp.Body)
+			if c.status != 200 {
+				assert.Equal(t, ErrInvalidRequest, errorBody(t, resp).Code)
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, "arn:aws:iam::123456789012:role/"+c.role, got.RoleArn)
+			assert.Equal(t, c.wantARNs, got.PolicyARNs)
+		})
+	}
+}
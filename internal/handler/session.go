@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// defaultSessionNameTemplate names sessions after the user's email, as the
+// role session name shows up in CloudTrail and assumed-role ARNs.
+const defaultSessionNameTemplate = "{{.email}}"
+
+// sourceIdentityClaim is the claim STS reads the source identity from for
+// AssumeRoleWithWebIdentity.
+const sourceIdentityClaim = "https://aws.amazon.com/source_identity"
+
+// Limits shared by STS RoleSessionName and SourceIdentity.
+const (
+	stsIdentifierMinLen = 2
+	stsIdentifierMaxLen = 64
+)
+
+// stsIdentifierInvalid matches characters STS rejects in RoleSessionName and
+// SourceIdentity ([\w+=,.@-]).
+var stsIdentifierInvalid = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// parseSessionNameTemplate parses the configured template, or the default.
+func parseSessionNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultSessionNameTemplate
+	}
+	return template.New("session_name").Option("missingkey=error").Parse(text)
+}
+
+// renderSessionName executes the session name template against the ID token
+// claims and makes the result acceptable to STS.
+func renderSessionName(text string, claims map[string]any) (string, error) {
+	tmpl, err := parseSessionNameTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, claims); err != nil {
+		return "", err
+	}
+	return sanitizeSTSIdentifier(b.String())
+}
+
+// claimString returns a string claim, or an error if it is missing or not a string.
+func claimString(claims map[string]any, name string) (string, error) {
+	v, ok := claims[name].(string)
+	if !ok || v == "" {
+		return "", fmt.Errorf("claim %q not found in id_token", name)
+	}
+	return v, nil
+}
+
+// sanitizeSTSIdentifier replaces characters STS does not accept and shortens
+// overlong values.  Truncated values keep a hash of the original, so that
+// distinct long identities stay distinct.
+func sanitizeSTSIdentifier(s string) (string, error) {
+	out := stsIdentifierInvalid.ReplaceAllString(s, "-")
+	if len(out) > stsIdentifierMaxLen {
+		sum := sha256.Sum256([]byte(s))
+		suffix := "-" + hex.EncodeToString(sum[:4])
+		out = out[:stsIdentifierMaxLen-len(suffix)] + suffix
+	}
+	if len(out) < stsIdentifierMinLen {
+		return "", errors.New("identifier shorter than 2 characters")
+	}
+	return out, nil
+}
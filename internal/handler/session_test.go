@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestRenderSessionName(t *testing.T) {
+	claims := map[string]any{
+		"email":              "foo@bar.com",
+		"sub":                "00u1abcd",
+		"preferred_username": "Foo Bar (ext)",
+	}
+	long := strings.Repeat("a", 80) + "@example.com"
+	cases := []struct {
+		name     string
+		template string
+		claims   map[string]any
+		want     string
+		errMsg   string
+	}{
+		{"default", "", claims, "foo@bar.com", ""},
+		{"sub", "{{.sub}}", claims, "00u1abcd", ""},
+		{"sanitized", "{{.preferred_username}}", claims, "Foo-Bar--ext-", ""},
+		{"combined", "{{.sub}}+{{.email}}", claims, "00u1abcd+foo@bar.com", ""},
+		{"missing claim", "{{.email}}", map[string]any{"sub": "x"}, "", "no entry for key"},
+		{"too short", "{{.sub}}", map[string]any{"sub": "x"}, "", "shorter than 2"},
+		{"bad template", "{{.sub", claims, "", "unclosed action"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := renderSessionName(c.template, c.claims)
+			if c.errMsg != "" {
+				assert.ErrorContains(t, err, c.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		got, err := renderSessionName("", map[string]any{"email": long})
+		require.NoError(t, err)
+		assert.Len(t, got, stsIdentifierMaxLen)
+		assert.True(t, strings.HasPrefix(got, "aaaa"))
+		other, _ := renderSessionName("", map[string]any{"email": strings.Repeat("a", 80) + "@example.org"})
+		assert.NotEqual(t, got, other)
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{SessionNameTemplate: "{{.sub}}"}.Validate())
+	assert.Error(t, Config{SessionNameTemplate: "{{.sub"}.Validate())
+}
+
+func TestHandleCreds_SessionIdentity(t *testing.T) {
+	cases := []struct {
+		name        string
+		cfg         Config
+		claims      jwt.MapClaims
+		status      int
+		sessionName string
+		errMsg      string
+	}{
+		{"default email", Config{}, jwt.MapClaims{"email": "foo@bar.com"}, 200, "foo@bar.com", ""},
+		{"missing email", Config{}, jwt.MapClaims{"sub": "u1"}, 403, "", "failed to build role session name"},
+		{"template", Config{SessionNameTemplate: "{{.sub}}"}, jwt.MapClaims{"sub": "u1"}, 200, "u1", ""},
+		{"source identity asserted", Config{SourceIdentityClaim: "preferred_username"},
+			jwt.MapClaims{"email": "foo@bar.com", "preferred_username": "foo bar", sourceIdentityClaim: "foo-bar"}, 200, "foo@bar.com", ""},
+		{"source identity not asserted", Config{SourceIdentityClaim: "preferred_username"},
+			jwt.MapClaims{"email": "foo@bar.com", "preferred_username": "foo"}, 403, "", `must assert https://aws.amazon.com/source_identity "foo"`},
+		{"source identity claim missing", Config{SourceIdentityClaim: "preferred_username"},
+			jwt.MapClaims{"email": "foo@bar.com"}, 403, "", `claim "preferred_username" not found`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.claims["nonce"] = testNonce
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c.claims).SignedString([]byte("secret"))
+			tok := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": raw})
+			h := newTestHandler(nil, tok, nil)
+			cfg := c.cfg
+			cfg.StateKey = h.Config.StateKey
+			h.Config = cfg
+			var got *awsutils.WebIdentityInput
+			sts := h.STSClient.(*awsutils.MockSTSClient)
+			next := sts.AssumeRoleWithWebIdentityFunc
+			sts.AssumeRoleWithWebIdentityFunc = func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
+				got = in
+				return next(ctx, in)
+			}
+
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode)
+			if c.status != 200 {
+				assert.Contains(t, errorBody(t, resp).Message, c.errMsg)
+			}
+			if c.status == 200 {
+				require.NotNil(t, got)
+				assert.Equal(t, c.sessionName, got.RoleSessionName)
+				assert.Equal(t, "arn:aws:iam::123456789012:role/r", got.RoleArn)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// stateAudience scopes state envelopes so they cannot be confused with other
+// tokens signed by the same key.
+const stateAudience = "aws-oidc-state"
+
+// defaultStateTTL bounds how long a login flow may take between /auth and /creds.
+const defaultStateTTL = 10 * time.Minute
+
+var errInvalidState = errors.New("invalid state")
+
+// StateClaims is the payload of the signed state envelope that HandleAuth
+// passes to the IdP in place of the client's state.  It binds the PKCE
+// challenge, the redirect URI, the nonce and, optionally, the DPoP and
+// encryption key thumbprints and the requested account and role to the flow,
+// so that HandleCreds can verify them without server-side storage.
+type StateClaims struct {
+	State       string `json:"state"`
+	Challenge   string `json:"challenge"`
+	RedirectURI string `json:"redirect_uri"`
+	Nonce       string `json:"nonce"`
+	DPoPJKT     string `json:"dpop_jkt,omitempty"`
+	EncJKT      string `json:"enc_jkt,omitempty"`
+	Account     string `json:"account,omitempty"`
+	Role        string `json:"role,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ParseStateUnverified decodes a state envelope without checking its
+// signature.  The CLI uses it to match the embedded client state; only the
+// server can verify the envelope.
+func ParseStateUnverified(envelope string) (*StateClaims, error) {
+	claims := &StateClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(envelope, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// signState wraps the client state into a signed, time-limited envelope.
+func (h *AwsCredsHandler) signState(claims StateClaims) (string, error) {
+	ttl := h.Config.StateTTL
+	if ttl == 0 {
+		ttl = defaultStateTTL
+	}
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{stateAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.Config.StateKey)
+}
+
+// verifyState checks the signature, audience and expiry of a state envelope.
+func (h *AwsCredsHandler) verifyState(envelope string) (*StateClaims, error) {
+	claims := &StateClaims{}
+	_, err := jwt.ParseWithClaims(envelope, claims, func(*jwt.Token) (any, error) {
+		return h.Config.StateKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(stateAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidState, err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	h := &AwsCredsHandler{Config: Config{StateKey: []byte("key")}}
+	envelope, err := h.signState(StateClaims{State: "s", Challenge: "c", RedirectURI: "r", Account: "a", Role: "ro"})
+	assert.NoError(t, err)
+
+	claims, err := h.verifyState(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "s", claims.State)
+	assert.Equal(t, "c", claims.Challenge)
+	assert.Equal(t, "r", claims.RedirectURI)
+	assert.Equal(t, "a", claims.Account)
+	assert.Equal(t, "ro", claims.Role)
+
+	unverified, err := ParseStateUnverified(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "s", unverified.State)
+}
+
+func TestVerifyState_Rejects(t *testing.T) {
+	h := &AwsCredsHandler{Config: Config{StateKey: []byte("key")}}
+	other := &AwsCredsHandler{Config: Config{StateKey: []byte("other")}}
+	expired := &AwsCredsHandler{Config: Config{StateKey: []byte("key"), StateTTL: -time.Minute}}
+
+	wrongKey, _ := other.signState(StateClaims{State: "s"})
+	old, _ := expired.signState(StateClaims{State: "s"})
+	wrongAud, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state": "s",
+		"aud":   "other",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte("key"))
+	noExp, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state": "s",
+		"aud":   stateAudience,
+	}).SignedString([]byte("key"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"state": "s",
+		"aud":   stateAudience,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	for name, envelope := range map[string]string{
+		"wrong key":      wrongKey,
+		"expired":        old,
+		"wrong audience": wrongAud,
+		"no expiry":      noExp,
+		"alg none":       unsigned,
+		"garbage":        "notatoken",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := h.verifyState(envelope)
+			assert.ErrorIs(t, err, errInvalidState)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// stepUpError reports an ID token that does not meet a rule's authentication
+// requirements.
+type stepUpError struct {
+	reason    string
+	acrValues []string
+}
+
+func (e *stepUpError) Error() string {
+	return e.reason
+}
+
+// checkAuthentication requires the ID token to carry one of the rule's acr
+// values and all of its amr entries.
+func checkAuthentication(rule *RoleRule, claims map[string]any) *stepUpError {
+	if rule == nil {
+		return nil
+	}
+	if len(rule.ACRValues) > 0 {
+		acr, _ := claims["acr"].(string)
+		if !slices.Contains(rule.ACRValues, acr) {
+			return &stepUpError{
+				reason:    fmt.Sprintf("role requires acr %s", strings.Join(rule.ACRValues, " or ")),
+				acrValues: rule.ACRValues,
+			}
+		}
+	}
+	amr, _ := claims["amr"].([]any)
+	for _, want := range rule.AMR {
+		if !slices.Contains(amr, any(want)) {
+			return &stepUpError{
+				reason:    fmt.Sprintf("role requires amr %s", want),
+				acrValues: rule.ACRValues,
+			}
+		}
+	}
+	return nil
+}
+
+// apiError reports the stepUpError to the client with the acr values to
+// request.  Without acr values, logging in again is unlikely to satisfy the
+// rule, so the claims are rejected instead.
+func (e *stepUpError) apiError() *apiError {
+	if len(e.acrValues) == 0 {
+		return claimsRejected(e)
+	}
+	return &apiError{status: http.StatusUnauthorized, code: ErrStepUpRequired, err: e, acrValues: e.acrValues}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestCheckAuthentication(t *testing.T) {
+	mfa := &RoleRule{ACRValues: []string{"phrh", "phr"}, AMR: []string{"hwk", "user"}}
+	cases := []struct {
+		name   string
+		rule   *RoleRule
+		claims map[string]any
+		reason string
+	}{
+		{"no rule", nil, map[string]any{}, ""},
+		{"no requirements", &RoleRule{Role: "x"}, map[string]any{}, ""},
+		{"satisfied", mfa, map[string]any{"acr": "phr", "amr": []any{"user", "hwk", "pin"}}, ""},
+		{"missing acr", mfa, map[string]any{"amr": []any{"hwk", "user"}}, "role requires acr phrh or phr"},
+		{"weak acr", mfa, map[string]any{"acr": "pwd", "amr": []any{"hwk", "user"}}, "role requires acr phrh or phr"},
+		{"missing amr", mfa, map[string]any{"acr": "phr", "amr": []any{"pwd"}}, "role requires amr hwk"},
+		{"amr only", &RoleRule{AMR: []string{"mfa"}}, map[string]any{"acr": "1"}, "role requires amr mfa"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkAuthentication(c.rule, c.claims)
+			if c.reason == "" {
+				assert.Nil(t, err)
+				return
+			}
+			require.NotNil(t, err)
+			assert.Equal(t, c.reason, err.Error())
+			assert.Equal(t, c.rule.ACRValues, err.acrValues)
+		})
+	}
+}
+
+func TestHandleCreds_StepUpRequired(t *testing.T) {
+	raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email": "foo@bar.com",
+		"nonce": testNonce,
+		"acr":   "pwd",
+	}).SignedString([]byte("secret"))
+	h := newTestHandler(nil, (&oauth2.Token{}).WithExtra(map[string]any{"id_token": raw}), nil)
+	h.Config.Rules = []RoleRule{
+		{Role: "*-admin", ACRValues: []string{"phrh"}},
+		{Role: "*-operator", AMR: []string{"hwk"}},
+	}
+
+	for role, status := range map[string]int{"prod-admin": 401, "prod-operator": 403, "readonly": 200} {
+		b := CredsRequest{Code: "c", Verifier: "v", Account: "123456789012", Role: role, RedirectURI: testRedirectURI, EncryptionKey: testEncryptionJWK()}
+		b.State = signTestState(t, h, b)
+		data, _ := json.Marshal(b)
+		resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{
+			Body:           string(data),
+			RequestContext: events.APIGatewayProxyRequestContext{RequestID: "req-1"},
+		})
+		require.Equal(t, status, resp.StatusCode, role)
+		if status == 403 {
+			// Nothing to ask the IdP for, so the client must not retry
+			e := errorBody(t, resp)
+			assert.Equal(t, ErrClaimsRejected, e.Code)
+			assert.Equal(t, "role requires amr hwk", e.Message)
+			assert.False(t, e.Retryable)
+		}
+		if status != 401 {
+			continue
+		}
+		assert.Equal(t, "application/json", resp.Headers["Content-Type"])
+		var e ErrorResponse
+		require.NoError(t, json.Unmarshal([]byte(resp.Body), &e))
+		assert.Equal(t, ErrorResponse{
+			Code:      ErrStepUpRequired,
+			Message:   "role requires acr phrh",
+			RequestID: "req-1",
+			ACRValues: "phrh",
+		}, e)
+	}
+}
+
+func TestHandleAuth_StepUpParams(t *testing.T) {
+	h := newTestHandler(nil, nil, nil)
+	params := func(extra map[string]string) map[string]string {
+		p := map[string]string{
+			"state":        "s",
+			"challenge":    "c",
+			"redirect_uri": testRedirectURI,
+			"nonce":        "n",
+		}
+		for k, v := range extra {
+			p[k] = v
+		}
+		return p
+	}
+
+	resp, _ := h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{
+		QueryStringParameters: params(map[string]string{"prompt": "login", "acr_values": "phrh phr"}),
+	})
+	require.Equal(t, 302, resp.StatusCode)
+	loc, err := url.Parse(resp.Headers["Location"])
+	require.NoError(t, err)
+	assert.Equal(t, "login", loc.Query().Get("prompt"))
+	assert.Equal(t, "phrh phr", loc.Query().Get("acr_values"))
+
+	resp, _ = h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: params(nil)})
+	require.Equal(t, 302, resp.StatusCode)
+	assert.NotContains(t, resp.Headers["Location"], "prompt=")
+	assert.NotContains(t, resp.Headers["Location"], "acr_values=")
+
+	resp, _ = h.HandleAuth(context.Background(), events.APIGatewayProxyRequest{
+		QueryStringParameters: params(map[string]string{"prompt": "none"}),
+	})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, `prompt "none" not allowed`, errorBody(t, resp).Message)
+}
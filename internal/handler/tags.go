@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+)
+
+// SessionTag maps an ID token claim to an STS session tag.
+type SessionTag struct {
+	// Claim names the ID token claim the tag value is taken from.
+	Claim string `json:"claim"`
+	// Key is the tag key.  Defaults to the claim name.
+	Key string `json:"key,omitempty"`
+	// Transitive tags persist through further role chaining.
+	Transitive bool `json:"transitive,omitempty"`
+}
+
+// tagsClaim is the claim STS reads session tags from for
+// AssumeRoleWithWebIdentity.
+const tagsClaim = "https://aws.amazon.com/tags"
+
+// tagListSeparator joins list claims, e.g. groups, into one tag value.
+const tagListSeparator = ":"
+
+// STS limits for session tags.
+const (
+	maxSessionTags    = 50
+	maxTagKeyLen      = 128
+	maxTagValueLen    = 256
+	tagCharacterClass = `\p{L}\p{Z}\p{N}_.:/=+\-@`
+)
+
+var (
+	tagKeyPattern   = regexp.MustCompile(`^[` + tagCharacterClass + `]+$`)
+	tagValueInvalid = regexp.MustCompile(`[^` + tagCharacterClass + `]`)
+)
+
+// key returns the tag key.
+func (t SessionTag) key() string {
+	if t.Key != "" {
+		return t.Key
+	}
+	return t.Claim
+}
+
+// validateSessionTags checks the configured tag mappings.
+func validateSessionTags(tags []SessionTag) error {
+	if len(tags) > maxSessionTags {
+		return fmt.Errorf("too many session tags (max %d)", maxSessionTags)
+	}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		if t.Claim == "" {
+			return errors.New("session tag without claim")
+		}
+		key := t.key()
+		if utf8.RuneCountInString(key) > maxTagKeyLen || !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid session tag key %q", key)
+		}
+		// Tag keys are case-insensitive in STS
+		if seen[strings.ToLower(key)] {
+			return fmt.Errorf("duplicate session tag key %q", key)
+		}
+		seen[strings.ToLower(key)] = true
+	}
+	return nil
+}
+
+// sessionTags derives session tags, and the keys of the transitive ones, from
+// the ID token claims.  Claims that are missing or neither strings nor lists
+// of strings are skipped.
+func sessionTags(mappings []SessionTag, claims map[string]any) (tags []awsutils.Tag, transitive []string) {
+	for _, m := range mappings {
+		value, ok := tagValue(claims[m.Claim])
+		if !ok {
+			continue
+		}
+		tags = append(tags, awsutils.Tag{Key: m.key(), Value: sanitizeTagValue(value)})
+		if m.Transitive {
+			transitive = append(transitive, m.key())
+		}
+	}
+	return tags, transitive
+}
+
+// tagValue converts a claim into a tag value.  Lists are joined, as tags
+// cannot be multi-valued.
+func tagValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", false
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, tagListSeparator), true
+	}
+	return "", false
+}
+
+// checkTagsClaim requires the ID token to assert the given tags in its
+// https://aws.amazon.com/tags claim, which is where STS takes session tags
+// from for AssumeRoleWithWebIdentity.  Other asserted tags are left alone.
+func checkTagsClaim(claims map[string]any, tags []awsutils.Tag, transitive []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var asserted struct {
+		PrincipalTags     map[string][]string `json:"principal_tags"`
+		TransitiveTagKeys []string            `json:"transitive_tag_keys"`
+	}
+	raw, err := json.Marshal(claims[tagsClaim])
+	if err == nil {
+		err = json.Unmarshal(raw, &asserted)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s claim: %w", tagsClaim, err)
+	}
+	for _, t := range tags {
+		if got := asserted.PrincipalTags[t.Key]; len(got) != 1 || got[0] != t.Value {
+			return fmt.Errorf("id_token must assert session tag %s=%q in %s", t.Key, t.Value, tagsClaim)
+		}
+	}
+	for _, key := range transitive {
+		if !slices.Contains(asserted.TransitiveTagKeys, key) {
+			return fmt.Errorf("id_token must assert session tag %s as transitive in %s", key, tagsClaim)
+		}
+	}
+	return nil
+}
+
+// sanitizeTagValue replaces characters STS does not accept in tag values and
+// truncates the value to the maximum length.
+func sanitizeTagValue(s string) string {
+	s = tagValueInvalid.ReplaceAllString(s, "-")
+	if utf8.RuneCountInString(s) > maxTagValueLen {
+		s = string([]rune(s)[:maxTagValueLen])
+	}
+	return s
+}
+
+// auditTags returns tags as a map for the audit log.
+func auditTags(tags []awsutils.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[t.Key] = t.Value
+	}
+	return m
+}
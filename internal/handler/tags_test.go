@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSessionTags(t *testing.T) {
+	assert.NoError(t, validateSessionTags(nil))
+	assert.NoError(t, validateSessionTags([]SessionTag{{Claim: "department"}, {Claim: "cost_center", Key: "CostCenter"}}))
+	assert.ErrorContains(t, validateSessionTags([]SessionTag{{Key: "Team"}}), "without claim")
+	assert.ErrorContains(t, validateSessionTags([]SessionTag{{Claim: "https://example.com/team"}, {Claim: "x", Key: "a,b"}}), `invalid session tag key "a,b"`)
+	assert.ErrorContains(t, validateSessionTags([]SessionTag{{Claim: "team"}, {Claim: "group", Key: "Team"}}), "duplicate")
+	assert.ErrorContains(t, validateSessionTags([]SessionTag{{Claim: strings.Repeat("k", maxTagKeyLen+1)}}), "invalid session tag key")
+	assert.ErrorContains(t, validateSessionTags(make([]SessionTag, maxSessionTags+1)), "too many")
+}
+
+func TestSessionTags(t *testing.T) {
+	mappings := []SessionTag{
+		{Claim: "department", Key: "Department", Transitive: true},
+		{Claim: "cost_center", Key: "CostCenter"},
+		{Claim: "team"},
+		{Claim: "groups", Key: "Groups", Transitive: true},
+		{Claim: "missing", Transitive: true},
+		{Claim: "mixed"},
+	}
+	claims := map[string]any{
+		"department":  "R&D (Berlin)",
+		"cost_center": strings.Repeat("é", maxTagValueLen+10),
+		"team":        "platform",
+		"groups":      []any{"admins", "dev ops"},
+		"mixed":       []any{"a", 1.0},
+	}
+	tags, transitive := sessionTags(mappings, claims)
+	assert.Equal(t, []awsutils.Tag{
+		{Key: "Department", Value: "R-D -Berlin-"},
+		{Key: "CostCenter", Value: strings.Repeat("é", maxTagValueLen)},
+		{Key: "team", Value: "platform"},
+		{Key: "Groups", Value: "admins:dev ops"},
+	}, tags)
+	assert.Equal(t, []string{"Department", "Groups"}, transitive)
+}
+
+func TestCheckTagsClaim(t *testing.T) {
+	tags := []awsutils.Tag{{Key: "Department", Value: "R-D"}, {Key: "Team", Value: "platform"}}
+	claims := func(tagsClaimValue any) map[string]any {
+		return map[string]any{tagsClaim: tagsClaimValue}
+	}
+	asserted := map[string]any{
+		"principal_tags":      map[string]any{"Department": []any{"R-D"}, "Team": []any{"platform"}, "Other": []any{"x"}},
+		"transitive_tag_keys": []any{"Department"},
+	}
+
+	assert.NoError(t, checkTagsClaim(nil, nil, nil))
+	assert.NoError(t, checkTagsClaim(claims(asserted), tags, []string{"Department"}))
+	assert.ErrorContains(t, checkTagsClaim(claims(asserted), tags, []string{"Team"}), "session tag Team as transitive")
+	assert.ErrorContains(t, checkTagsClaim(nil, tags, nil), `must assert session tag Department="R-D"`)
+	assert.ErrorContains(t, checkTagsClaim(claims(map[string]any{
+		"principal_tags": map[string]any{"Department": []any{"R&D"}, "Team": []any{"platform"}},
+	}), tags, nil), `must assert session tag Department="R-D"`)
+	assert.ErrorContains(t, checkTagsClaim(claims(map[string]any{
+		"principal_tags": map[string]any{"Department": []any{"R-D", "x"}},
+	}), tags, nil), "Department")
+	assert.ErrorContains(t, checkTagsClaim(claims("nope"), tags, nil), "invalid https://aws.amazon.com/tags claim")
+}
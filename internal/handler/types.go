@@ -2,6 +2,8 @@ package handler
 
 import (
 	"time"
+
+	"github.com/michaelw/aws-oidc-cli/internal/jwe"
 )
 
 // AuthRequest is the input for /auth.
@@ -9,6 +11,19 @@ type AuthRequest struct {
 	Challenge   string `json:"challenge"`
 	State       string `json:"state"`
 	RedirectURI string `json:"redirect_uri"`
+	Nonce       string `json:"nonce"`
+	DPoPJKT     string `json:"dpop_jkt,omitempty"`
+	EncJKT      string `json:"enc_jkt,omitempty"`
+	Account     string `json:"account,omitempty"`
+	Role        string `json:"role,omitempty"`
+	ACRValues   string `json:"acr_values,omitempty"`
+	Prompt      string `json:"prompt,omitempty"`
+	LoginHint   string `json:"login_hint,omitempty"`
+	DomainHint  string `json:"domain_hint,omitempty"`
+	// Scope adds space-separated scopes to the configured ones.
+	Scope string `json:"scope,omitempty"`
+	// Provider selects a named issuer, unless the path does.
+	Provider string `json:"provider,omitempty"`
 }
 
 // CredsRequest is the input for /creds POST endpoint.
@@ -18,9 +33,36 @@ type CredsRequest struct {
 	Account     string `json:"account"`
 	Role        string `json:"role"`
 	RedirectURI string `json:"redirect_uri"`
+	State       string `json:"state"`
+	// EncryptionKey is the CLI's ephemeral X25519 public key.
+	EncryptionKey *jwe.JWK `json:"encryption_key,omitempty"`
+	// Policy and PolicyARNs are optional session policies to down-scope the credentials.
+	Policy     string   `json:"policy,omitempty"`
+	PolicyARNs []string `json:"policy_arns,omitempty"`
+	// Duration is the requested session duration in seconds.  Zero selects
+	// the server default; longer requests are capped by the server.
+	Duration int32 `json:"duration,omitempty"`
+	// Provider selects a named issuer, unless the path does.
+	Provider string `json:"provider,omitempty"`
+}
+
+// ErrorResponse is the JSON body of error responses.  Code is one of the
+// Err* constants.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID identifies the request in the server's logs and audit events.
+	RequestID string `json:"request_id,omitempty"`
+	// Retryable reports whether the same request may succeed later.  Requests
+	// that redeemed an authorization code need a new login regardless.
+	Retryable bool `json:"retryable"`
+	// ACRValues are the space-separated acr values to request at /auth, for
+	// ErrStepUpRequired.
+	ACRValues string `json:"acr_values,omitempty"`
 }
 
-// CredsResponse is the output for /auth.
+// CredsResponse is the output for /creds, sealed as a JWE to
+// CredsRequest.EncryptionKey unless plaintext responses are allowed.
 type CredsResponse struct {
 	Version         int
 	AccessKeyId     string
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"text/template/parse"
+
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+)
+
+// identityClaims returns the claims the configuration reads from the
+// identity: those referenced by the session name template, the source
+// identity claim and the session tag claims.
+func (c Config) identityClaims() []string {
+	var names []string
+	if tmpl, err := parseSessionNameTemplate(c.SessionNameTemplate); err == nil {
+		names = templateFields(tmpl.Tree.Root, names)
+	}
+	if c.SourceIdentityClaim != "" {
+		names = append(names, c.SourceIdentityClaim)
+	}
+	for _, t := range c.SessionTags {
+		names = append(names, t.Claim)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// templateFields collects the top-level fields a session name template reads,
+// as {{.name}} or {{index . "name"}}.
+func templateFields(node parse.Node, names []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return names
+		}
+		for _, c := range n.Nodes {
+			names = templateFields(c, names)
+		}
+	case *parse.ActionNode:
+		names = templateFields(n.Pipe, names)
+	case *parse.IfNode:
+		names = templateFields(&n.BranchNode, names)
+	case *parse.RangeNode:
+		names = templateFields(&n.BranchNode, names)
+	case *parse.WithNode:
+		names = templateFields(&n.BranchNode, names)
+	case *parse.BranchNode:
+		names = templateFields(n.Pipe, names)
+		names = templateFields(n.List, names)
+		names = templateFields(n.ElseList, names)
+	case *parse.PipeNode:
+		if n == nil {
+			return names
+		}
+		for _, c := range n.Cmds {
+			names = templateFields(c, names)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) >= 3 {
+			fn, _ := n.Args[0].(*parse.IdentifierNode)
+			_, dot := n.Args[1].(*parse.DotNode)
+			key, _ := n.Args[2].(*parse.StringNode)
+			if fn != nil && fn.Ident == "index" && dot && key != nil {
+				names = append(names, key.Text)
+			}
+		}
+		for _, a := range n.Args {
+			names = templateFields(a, names)
+		}
+	case *parse.FieldNode:
+		names = append(names, n.Ident[0])
+	}
+	return names
+}
+
+// mergeUserInfo fills in configured identity claims missing from the ID
+// token from the userinfo endpoint.  Claims in the ID token take precedence,
+// and nothing is fetched if none are missing.  Providers without a userinfo
+// endpoint are skipped, leaving the missing claims to be reported later.
+func (h *AwsCredsHandler) mergeUserInfo(ctx context.Context, accessToken string, claims map[string]any) error {
+	var missing []string
+	for _, name := range h.Config.identityClaims() {
+		if _, ok := claims[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	info, err := h.OIDCClient.UserInfo(ctx, accessToken)
+	if errors.Is(err, oidc.ErrUserInfoNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return &apiError{status: http.StatusBadGateway, code: ErrIdPError,
+			err: fmt.Errorf("failed to fetch userinfo: %w", err), retryable: true}
+	}
+	// The userinfo response must be about the same user (OIDC Core 5.3.2)
+	if sub, _ := claims["sub"].(string); info.Subject == "" || info.Subject != sub {
+		return claimsRejected(errors.New("userinfo sub does not match id_token"))
+	}
+	var extra map[string]any
+	if err := info.Claims(&extra); err != nil {
+		return newAPIError(http.StatusBadGateway, ErrIdPError, fmt.Errorf("failed to parse userinfo: %w", err))
+	}
+	for _, name := range missing {
+		if v, ok := extra[name]; ok {
+			claims[name] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/michaelw/aws-oidc-cli/internal/awsutils"
+	"github.com/michaelw/aws-oidc-cli/internal/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestConfigIdentityClaims(t *testing.T) {
+	assert.Equal(t, []string{"email"}, Config{}.identityClaims())
+	cfg := Config{
+		SessionNameTemplate: `{{.preferred_username}}-{{index . "https://example.com/id"}}{{if .sub}}{{.sub}}{{end}}`,
+		SourceIdentityClaim: "preferred_username",
+		SessionTags:         []SessionTag{{Claim: "groups"}, {Claim: "department", Key: "dept"}},
+	}
+	assert.Equal(t, []string{"department", "groups", "https://example.com/id", "preferred_username", "sub"}, cfg.identityClaims())
+}
+
+func TestHandleCreds_UserInfo(t *testing.T) {
+	cases := []struct {
+		name        string
+		claims      jwt.MapClaims
+		userInfo    string
+		userInfoErr error
+		status      int
+		sessionName string
+		errMsg      string
+		fetched     bool
+	}{
+		{"claims in id_token", jwt.MapClaims{"sub": "u1", "email": "foo@bar.com"}, "", nil, 200, "foo@bar.com", "", false},
+		{"merged", jwt.MapClaims{"sub": "u1"}, `{"sub":"u1","email":"foo@bar.com"}`, nil, 200, "foo@bar.com", "", true},
+		{"sub mismatch", jwt.MapClaims{"sub": "u1"}, `{"sub":"u2","email":"foo@bar.com"}`, nil, 403, "", "userinfo sub does not match", true},
+		{"not supported", jwt.MapClaims{"sub": "u1"}, "", oidc.ErrUserInfoNotSupported, 403, "", "failed to build role session name", true},
+		{"error", jwt.MapClaims{"sub": "u1"}, "", errors.New("boom"), 502, "", "failed to fetch userinfo: boom", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.claims["nonce"] = testNonce
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c.claims).SignedString([]byte("secret"))
+			tok := (&oauth2.Token{AccessToken: "at"}).WithExtra(map[string]any{"id_token": raw})
+			h := newTestHandler(nil, tok, nil)
+			fetched := false
+			h.OIDCClient.(*oidc.MockOIDCClient).UserInfoFunc = func(ctx context.Context, accessToken string) (*oidc.UserInfo, error) {
+				fetched = true
+				assert.Equal(t, "at", accessToken)
+				if c.userInfoErr != nil {
+					return nil, c.userInfoErr
+				}
+				var claims map[string]any
+				require.NoError(t, json.Unmarshal([]byte(c.userInfo), &claims))
+				sub, _ := claims["sub"].(string)
+				return &oidc.UserInfo{Subject: sub, RawClaims: json.RawMessage(c.userInfo)}, nil
+			}
+			var got *awsutils.WebIdentityInput
+			sts := h.STSClient.(*awsutils.MockSTSClient)
+			next := sts.AssumeRoleWithWebIdentityFunc
+			sts.AssumeRoleWithWebIdentityFunc = func(ctx context.Context, in *awsutils.WebIdentityInput) (*awsutils.Credentials, error) {
+				got = in
+				return next(ctx, in)
+			}
+
+			b := CredsRequest{
+				Code:          "c",
+				Verifier:      "v",
+				Account:       "123456789012",
+				Role:          "r",
+				RedirectURI:   testRedirectURI,
+				EncryptionKey: testEncryptionJWK(),
+			}
+			b.State = signTestState(t, h, b)
+			data, _ := json.Marshal(b)
+			resp, _ := h.HandleCreds(context.Background(), events.APIGatewayProxyRequest{Body: string(data)})
+			assert.Equal(t, c.status, resp.StatusCode)
+			if c.status != 200 {
+				assert.Contains(t, errorBody(t, resp).Message, c.errMsg)
+			}
+			assert.Equal(t, c.fetched, fetched)
+			if c.status == 200 {
+				require.NotNil(t, got)
+				assert.Equal(t, c.sessionName, got.RoleSessionName)
+			}
+		})
+	}
+}
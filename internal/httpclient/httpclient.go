@@ -0,0 +1,229 @@
+// Package httpclient builds the HTTP client the CLI uses to call a
+// provider's API, with timeouts, retries, TLS settings, extra headers and
+// SigV4 signing from the provider configuration.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds each attempt of a request.
+	DefaultTimeout = 30 * time.Second
+	// DefaultRetries is how often a failing request is retried.
+	DefaultRetries = 2
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 5 * time.Second
+	// maxRetryAfter is the longest Retry-After the client waits for; a
+	// response asking for more is returned instead.
+	maxRetryAfter = 30 * time.Second
+)
+
+// Config holds the HTTP settings of a provider.  File paths are used as
+// given; callers expand them.
+type Config struct {
+	// Timeout bounds each attempt, in seconds.  Zero selects DefaultTimeout.
+	Timeout int `json:"timeout,omitempty"`
+	// Retries is how often requests failing with 5xx or 429 are retried.
+	// Unset selects DefaultRetries; zero disables retries.
+	Retries *int `json:"retries,omitempty"`
+	// Proxy is the URL of the proxy for HTTPS requests.  Unset uses
+	// HTTPS_PROXY and NO_PROXY from the environment.
+	Proxy string `json:"proxy,omitempty"`
+	// CABundle is a PEM file of CA certificates to trust in addition to the
+	// system roots, e.g. for a corporate TLS-inspecting proxy.
+	CABundle string `json:"ca_bundle,omitempty"`
+	// ClientCert and ClientKey are PEM files of a client certificate and
+	// its key, for API Gateway custom domains that require mutual TLS.
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// Headers are set on every request, e.g. an API Gateway x-api-key.
+	Headers map[string]string `json:"headers,omitempty"`
+	// SigV4, if set, signs requests with ambient AWS credentials.
+	SigV4 *SigV4Config `json:"sigv4,omitempty"`
+}
+
+// Client sends requests with retries.
+type Client struct {
+	HTTP    *http.Client
+	Retries int
+	// RetryIf, if set, further decides whether a response failing with 5xx
+	// or 429 is retried, e.g. so that requests the server has partly
+	// processed are not repeated.  It must leave the body readable.
+	RetryIf func(resp *http.Response) bool
+
+	headers map[string]string
+	sigV4   *sigV4
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a client for cfg.  It returns redirects instead of following
+// them, so that the configured headers and signature are only sent to the
+// provider's API.
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", cfg.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := DefaultTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	retries := DefaultRetries
+	if cfg.Retries != nil {
+		retries = max(*cfg.Retries, 0)
+	}
+	c := &Client{
+		HTTP: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Retries: retries,
+		headers: cfg.Headers,
+		sleep:   sleep,
+	}
+	if cfg.SigV4 != nil {
+		if c.sigV4, err = newSigV4(ctx, *cfg.SigV4); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS settings for cfg, or nil for the defaults.
+func (cfg Config) tlsConfig() (*tls.Config, error) {
+	if cfg.CABundle == "" && cfg.ClientCert == "" && cfg.ClientKey == "" {
+		return nil, nil
+	}
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CABundle)
+		}
+		c.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// Do sends the request built by newRequest, retrying with jittered
+// exponential backoff while it fails with 5xx or 429 and RetryIf allows it,
+// and waiting at least as long as the server asks with Retry-After.
+// newRequest is called for every attempt, so that single-use headers such as
+// DPoP proofs are fresh; the configured headers and signature are added to
+// its requests.  The last response is returned if all attempts fail.
+func (c *Client) Do(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := c.request(ctx, newRequest)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.HTTP.Do(req)
+		if err != nil || attempt >= c.Retries || !retryable(resp.StatusCode) || (c.RetryIf != nil && !c.RetryIf(resp)) {
+			return resp, err
+		}
+		delay, ok := backoff(attempt, resp.Header.Get("Retry-After"))
+		if !ok {
+			return resp, nil
+		}
+		// Drain the body so the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		if err := c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// request builds a request with newRequest and adds the configured headers
+// and, last, the signature.
+func (c *Client) request(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Request, error) {
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	if c.sigV4 != nil {
+		if err := c.sigV4.sign(ctx, req); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+	return req, nil
+}
+
+// retryable reports whether a response with status may succeed if sent again.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff returns the delay before retry number attempt+1: a random delay
+// between half and all of an exponentially growing bound, but no less than
+// Retry-After.  It returns false if the server asks to wait longer than
+// maxRetryAfter.
+func backoff(attempt int, retryAfter string) (time.Duration, bool) {
+	d := min(minBackoff<<min(attempt, 16), maxBackoff)
+	d = d/2 + rand.N(d/2+1)
+	if s, err := strconv.Atoi(retryAfter); err == nil && s > 0 {
+		wait := time.Duration(s) * time.Second
+		if wait > maxRetryAfter {
+			return 0, false
+		}
+		d = max(d, wait)
+	}
+	return d, true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
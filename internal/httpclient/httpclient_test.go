@@ -0,0 +1,295 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client for cfg that records its backoff delays
+// instead of sleeping.
+func newTestClient(t *testing.T, cfg Config) (*Client, *[]time.Duration) {
+	t.Helper()
+	c, err := New(context.Background(), cfg)
+	require.NoError(t, err)
+	var slept []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return c, &slept
+}
+
+func get(url string) func(context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	}
+}
+
+func TestDo_Retry(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		header   http.Header
+		want     int
+		attempts int
+	}{
+		{"success", []int{200}, nil, 200, 1},
+		{"server error", []int{502, 503, 200}, nil, 200, 3},
+		{"exhausted", []int{500, 500, 500, 200}, nil, 500, 3},
+		{"client error", []int{400, 200}, nil, 400, 1},
+		{"throttled", []int{429, 200}, http.Header{"Retry-After": {"7"}}, 200, 2},
+		{"retry after too long", []int{429, 200}, http.Header{"Retry-After": {"3600"}}, 429, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range c.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(c.statuses[attempts])
+				attempts++
+			}))
+			defer srv.Close()
+
+			client, slept := newTestClient(t, Config{})
+			built := 0
+			resp, err := client.Do(context.Background(), func(ctx context.Context) (*http.Request, error) {
+				built++
+				return get(srv.URL)(ctx)
+			})
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, c.want, resp.StatusCode)
+			assert.Equal(t, c.attempts, attempts)
+			assert.Equal(t, c.attempts, built, "fresh request per attempt")
+			require.Len(t, *slept, c.attempts-1)
+			for _, d := range *slept {
+				assert.LessOrEqual(t, d, maxRetryAfter)
+				if c.header != nil {
+					assert.Equal(t, 7*time.Second, d)
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(503)
+		}))
+		defer srv.Close()
+		zero := 0
+		client, _ := newTestClient(t, Config{Retries: &zero})
+		resp, err := client.Do(context.Background(), get(srv.URL))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := range 10 {
+		d, ok := backoff(attempt, "")
+		require.True(t, ok)
+		bound := min(minBackoff<<attempt, maxBackoff)
+		assert.GreaterOrEqual(t, d, bound/2)
+		assert.LessOrEqual(t, d, bound)
+	}
+}
+
+func TestNew_Timeout(t *testing.T) {
+	c, err := New(context.Background(), Config{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultTimeout, c.HTTP.Timeout)
+	assert.Equal(t, DefaultRetries, c.Retries)
+
+	c, err = New(context.Background(), Config{Timeout: 5})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, c.HTTP.Timeout)
+}
+
+func TestNew_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, _ := newTestClient(t, Config{Proxy: proxy.URL})
+	resp, err := client.Do(context.Background(), get("http://api.example.com/creds"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://api.example.com/creds", proxied)
+
+	_, err = New(context.Background(), Config{Proxy: "not a url"})
+	assert.Error(t, err)
+}
+
+// writePEM writes a PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+	return path
+}
+
+func TestNew_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aws-oidc"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, "client-key.pem", "PRIVATE KEY", keyDER)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	client, _ := newTestClient(t, Config{CABundle: caFile, ClientCert: certFile, ClientKey: keyFile})
+	resp, err := client.Do(context.Background(), get(srv.URL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	t.Run("without client certificate", func(t *testing.T) {
+		client, _ := newTestClient(t, Config{CABundle: caFile})
+		_, err := client.Do(context.Background(), get(srv.URL))
+		assert.Error(t, err)
+	})
+	t.Run("untrusted server", func(t *testing.T) {
+		client, _ := newTestClient(t, Config{ClientCert: certFile, ClientKey: keyFile})
+		_, err := client.Do(context.Background(), get(srv.URL))
+		assert.ErrorContains(t, err, "certificate")
+	})
+	t.Run("invalid config", func(t *testing.T) {
+		for name, cfg := range map[string]Config{
+			"missing key":   {ClientCert: certFile},
+			"missing CA":    {CABundle: filepath.Join(dir, "missing.pem")},
+			"empty bundle":  {CABundle: keyFile},
+			"mismatched":    {ClientCert: caFile, ClientKey: keyFile},
+			"missing files": {ClientCert: filepath.Join(dir, "x"), ClientKey: filepath.Join(dir, "y")},
+		} {
+			_, err := New(context.Background(), cfg)
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestDo_HeadersAndSigV4(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	client, _ := newTestClient(t, Config{Headers: map[string]string{"x-api-key": "k1"}})
+	now := time.Date(2025, 5, 15, 16, 45, 30, 0, time.UTC)
+	client.sigV4 = &sigV4{
+		signer: v4.NewSigner(),
+		credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		defaultRegion: "us-east-1",
+		now:           func() time.Time { return now },
+	}
+	resp, err := client.Do(context.Background(), func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/creds", strings.NewReader(`{"code":"c"}`))
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "k1", got.Get("x-api-key"))
+	assert.Equal(t, "20250515T164530Z", got.Get("X-Amz-Date"))
+	auth := got.Get("Authorization")
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20250515/us-east-1/execute-api/aws4_request"), auth)
+	assert.Contains(t, auth, "x-api-key", "static headers are signed")
+}
+
+func TestHostRegion(t *testing.T) {
+	assert.Equal(t, "eu-west-1", hostRegion("abc123.execute-api.eu-west-1.amazonaws.com"))
+	assert.Equal(t, "", hostRegion("aws-oidc.example.com"))
+	assert.Equal(t, "", hostRegion("127.0.0.1"))
+}
+
+func TestDo_RetryIf(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(503)
+		w.Write([]byte("final"))
+	}))
+	defer srv.Close()
+
+	client, slept := newTestClient(t, Config{})
+	client.RetryIf = func(resp *http.Response) bool {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		return string(b) != "final"
+	}
+	resp, err := client.Do(context.Background(), get(srv.URL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "final", string(b))
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, *slept)
+}
+
+func TestDo_Redirect(t *testing.T) {
+	followed := false
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer elsewhere.Close()
+	srv := httptest.NewServer(http.RedirectHandler(elsewhere.URL, http.StatusFound))
+	defer srv.Close()
+
+	client, _ := newTestClient(t, Config{Headers: map[string]string{"x-api-key": "k1"}})
+	resp, err := client.Do(context.Background(), get(srv.URL))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, elsewhere.URL, resp.Header.Get("Location"))
+	assert.False(t, followed)
+}
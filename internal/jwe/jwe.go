@@ -0,0 +1,181 @@
+// Package jwe seals payloads to an X25519 public key as a compact JWE
+// (RFC 7516) using direct key agreement: "alg":"ECDH-ES" with an ephemeral
+// X25519 key (RFC 8037) and "enc":"A256GCM".
+package jwe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/michaelw/aws-oidc-cli/internal/jwk"
+)
+
+const (
+	algECDHES  = "ECDH-ES"
+	encA256GCM = "A256GCM"
+	keySize    = 32
+)
+
+// ContentType is the media type of a compact JWE.
+const ContentType = "application/jose"
+
+var ErrDecrypt = errors.New("jwe: decryption failed")
+
+// JWK is an X25519 public key as an OKP JSON Web Key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+// PublicJWK encodes an X25519 public key.
+func PublicJWK(pub *ecdh.PublicKey) JWK {
+	return JWK{Kty: "OKP", Crv: "X25519", X: base64.RawURLEncoding.EncodeToString(pub.Bytes())}
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (k JWK) Thumbprint() string {
+	return jwk.Thumbprint(map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X})
+}
+
+// PublicKey decodes the key.
+func (k JWK) PublicKey() (*ecdh.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "X25519" {
+		return nil, fmt.Errorf("jwe: unsupported key type %s/%s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("jwe: malformed key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(x)
+}
+
+// header is the JWE protected header.
+type header struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+	EPK JWK    `json:"epk"`
+}
+
+// Encrypt seals plaintext to the recipient's public key.
+func Encrypt(plaintext []byte, recipient *ecdh.PublicKey) (string, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	z, err := eph.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	hdr, err := json.Marshal(header{
+		Alg: algECDHES,
+		Enc: encA256GCM,
+		Cty: "json",
+		EPK: PublicJWK(eph.PublicKey()),
+	})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(hdr)
+
+	aead, err := newAEAD(z)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	enc := base64.RawURLEncoding.EncodeToString
+	return strings.Join([]string{protected, "", enc(iv), enc(ciphertext), enc(tag)}, "."), nil
+}
+
+// Decrypt opens a compact JWE produced by Encrypt.
+func Decrypt(compact string, key *ecdh.PrivateKey) ([]byte, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, fmt.Errorf("%w: malformed compact serialization", ErrDecrypt)
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	rawHdr, err := dec(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	var hdr header
+	if err := json.Unmarshal(rawHdr, &hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	if hdr.Alg != algECDHES || hdr.Enc != encA256GCM {
+		return nil, fmt.Errorf("%w: unsupported alg/enc %s/%s", ErrDecrypt, hdr.Alg, hdr.Enc)
+	}
+	epk, err := hdr.EPK.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	z, err := key.ECDH(epk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	aead, err := newAEAD(z)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := dec(parts[2])
+	if err != nil || len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed iv", ErrDecrypt)
+	}
+	ciphertext, err := dec(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	tag, err := dec(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// newAEAD derives the content encryption key from the shared secret.
+func newAEAD(z []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(concatKDF(z, encA256GCM, nil, nil, keySize))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// concatKDF implements the single-round Concat KDF of NIST SP 800-56A as
+// profiled by RFC 7518, section 4.6.2.  size must not exceed 32 bytes.
+func concatKDF(z []byte, algID string, apu, apv []byte, size int) []byte {
+	h := sha256.New()
+	_ = binary.Write(h, binary.BigEndian, uint32(1)) // round counter
+	h.Write(z)
+	writeLengthPrefixed(h, []byte(algID))
+	writeLengthPrefixed(h, apu)
+	writeLengthPrefixed(h, apv)
+	_ = binary.Write(h, binary.BigEndian, uint32(size*8))
+	return h.Sum(nil)[:size]
+}
+
+func writeLengthPrefixed(w io.Writer, b []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint32(len(b)))
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,79 @@
+package jwe
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub, err := PublicJWK(key.PublicKey()).PublicKey()
+	require.NoError(t, err)
+
+	compact, err := Encrypt([]byte(`{"secret":true}`), pub)
+	require.NoError(t, err)
+	assert.NotContains(t, compact, "secret")
+
+	hdr, err := base64.RawURLEncoding.DecodeString(strings.Split(compact, ".")[0])
+	require.NoError(t, err)
+	var h header
+	require.NoError(t, json.Unmarshal(hdr, &h))
+	assert.Equal(t, "ECDH-ES", h.Alg)
+	assert.Equal(t, "A256GCM", h.Enc)
+	assert.Equal(t, "X25519", h.EPK.Crv)
+
+	plaintext, err := Decrypt(compact, key)
+	require.NoError(t, err)
+	assert.Equal(t, `{"secret":true}`, string(plaintext))
+}
+
+func TestDecrypt_Rejects(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	compact, err := Encrypt([]byte("payload"), key.PublicKey())
+	require.NoError(t, err)
+
+	parts := strings.Split(compact, ".")
+	tampered := append([]string(nil), parts...)
+	ct, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	ct[0] ^= 1
+	tampered[3] = base64.RawURLEncoding.EncodeToString(ct)
+
+	_, err = Decrypt(compact, other)
+	assert.ErrorIs(t, err, ErrDecrypt)
+	_, err = Decrypt(strings.Join(tampered, "."), key)
+	assert.ErrorIs(t, err, ErrDecrypt)
+	_, err = Decrypt("not.a.jwe", key)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestConcatKDF(t *testing.T) {
+	// RFC 7518, Appendix C
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156,
+		251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	want := []byte{86, 170, 141, 234, 248, 35, 109, 32, 92, 34, 40, 205, 113, 167, 16, 26}
+	assert.Equal(t, want, concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16))
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// RFC 8037, Appendix A.3
+	k := JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", k.Thumbprint())
+}
+
+func TestJWK_PublicKey(t *testing.T) {
+	_, err := JWK{Kty: "EC", Crv: "P-256", X: "AA"}.PublicKey()
+	assert.Error(t, err)
+	_, err = JWK{Kty: "OKP", Crv: "X25519", X: "AA"}.PublicKey()
+	assert.Error(t, err)
+}
@@ -0,0 +1,24 @@
+// Package jwk computes JSON Web Key thumbprints (RFC 7638), which bind DPoP
+// and encryption keys to a flow and identify client assertion keys.
+package jwk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Thumbprint returns the SHA-256 thumbprint of a key, base64url-encoded.
+// required holds the key's required members only, e.g. crv, kty, x and y
+// for EC keys, or e, kty and n for RSA keys.
+func Thumbprint(required map[string]string) string {
+	// Maps encode with their keys sorted and without whitespace, as the
+	// canonical form requires.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(required)
+	sum := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/michaelw/aws-oidc-cli/internal/jwk"
+)
+
+// ClientAssertionType is the client_assertion_type of private_key_jwt
+// client authentication (RFC 7523, section 2.2).
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime bounds how long a client assertion is accepted.
+const clientAssertionLifetime = 5 * time.Minute
+
+// minRSAKeyBits is the smallest RSA key accepted for signing.
+const minRSAKeyBits = 2048
+
+// SigningKey is a private key for private_key_jwt client authentication.
+type SigningKey struct {
+	// KeyID is the kid the key is published and referenced under.
+	KeyID string
+	// Key is an *rsa.PrivateKey or *ecdsa.PrivateKey.
+	Key crypto.Signer
+}
+
+// ParseSigningKeys parses one or more PEM-encoded private keys in PKCS #8,
+// PKCS #1 (RSA) or SEC 1 (EC) form.  A "kid" PEM header sets the key ID;
+// otherwise it is the key's RFC 7638 thumbprint.
+//
+// Clients sign with the first key and publish all of them, so a new key can
+// be published ahead of its use, and a retired one kept until the IdP no
+// longer caches it.
+func ParseSigningKeys(data []byte) ([]SigningKey, error) {
+	var keys []SigningKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		k := SigningKey{KeyID: block.Headers["kid"], Key: key}
+		if _, err := k.method(); err != nil {
+			return nil, err
+		}
+		if k.KeyID == "" {
+			k.KeyID = k.JWK().Thumbprint()
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM-encoded private key found")
+	}
+	return keys, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// method returns the JWS algorithm the key signs with.
+func (k SigningKey) method() (jwt.SigningMethod, error) {
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key shorter than %d bits", minRSAKeyBits)
+		}
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", k.Key)
+}
+
+// JWK is a public JSON Web Key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// EC keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public key as a JWK.
+func (k SigningKey) JWK() JWK {
+	jwk := JWK{Kid: k.KeyID, Use: "sig"}
+	if m, err := k.method(); err == nil {
+		jwk.Alg = m.Alg()
+	}
+	switch pub := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		b, _ := pub.Bytes() // uncompressed point: 0x04 || X || Y
+		size := (len(b) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(b[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(b[1+size:])
+	}
+	return jwk
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (k JWK) Thumbprint() string {
+	if k.Kty == "RSA" {
+		return jwk.Thumbprint(map[string]string{"e": k.E, "kty": k.Kty, "n": k.N})
+	}
+	return jwk.Thumbprint(map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X, "y": k.Y})
+}
+
+// PublicJWKS returns the public keys as a JWKS for the IdP to fetch.
+func PublicJWKS(keys []SigningKey) JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.JWK())
+	}
+	return set
+}
+
+// clientAssertion signs a private_key_jwt client assertion (RFC 7523,
+// section 3) for audience, normally the token endpoint.
+func clientAssertion(key SigningKey, clientID, audience string) (string, error) {
+	method, err := key.method()
+	if err != nil {
+		return "", err
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	tok := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		Issuer:    clientID,
+		Subject:   clientID,
+		Audience:  jwt.ClaimStrings{audience},
+		ID:        base64.RawURLEncoding.EncodeToString(jti),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	})
+	tok.Header["kid"] = key.KeyID
+	return tok.SignedString(key.Key)
+}
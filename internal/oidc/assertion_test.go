@@ -0,0 +1,139 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRSAKeyPEM(t *testing.T, bits int, headers map[string]string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Headers: headers, Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func testECKeyPEM(t *testing.T, curve elliptic.Curve) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	data := append(testECKeyPEM(t, elliptic.P256()), testRSAKeyPEM(t, 2048, map[string]string{"kid": "old"})...)
+	keys, err := ParseSigningKeys(data)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, keys[0].JWK().Thumbprint(), keys[0].KeyID, "kid defaults to the thumbprint")
+	assert.Equal(t, "old", keys[1].KeyID)
+
+	set := PublicJWKS(keys)
+	require.Len(t, set.Keys, 2)
+	assert.Equal(t, "EC", set.Keys[0].Kty)
+	assert.Equal(t, "P-256", set.Keys[0].Crv)
+	assert.Equal(t, "ES256", set.Keys[0].Alg)
+	assert.Len(t, set.Keys[0].X, 43)
+	assert.Equal(t, "RSA", set.Keys[1].Kty)
+	assert.Equal(t, "RS256", set.Keys[1].Alg)
+	assert.Equal(t, "AQAB", set.Keys[1].E)
+
+	for name, data := range map[string][]byte{
+		"no key":         []byte("not a key"),
+		"short RSA key":  testRSAKeyPEM(t, 1024, nil),
+		"unknown block":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}),
+		"malformed key":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}),
+		"unknown curve":  testECKeyPEM(t, elliptic.P224()),
+		"public key":     pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}),
+		"empty document": nil,
+	} {
+		_, err := ParseSigningKeys(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638, section 3.1
+	k := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", k.Thumbprint())
+}
+
+func newKeyClient(t *testing.T, idp *FakeIdP, keys []SigningKey) OIDCClient {
+	t.Helper()
+	provider, err := coreosoidc.NewProvider(context.Background(), idp.URL)
+	require.NoError(t, err)
+	return NewOIDCClientWithKeys(provider, "client id", func(context.Context) ([]SigningKey, error) {
+		return keys, nil
+	})
+}
+
+// verifyAssertion checks a client assertion against key.
+func verifyAssertion(t *testing.T, assertion string, key SigningKey, audience string) {
+	t.Helper()
+	var claims jwt.RegisteredClaims
+	tok, err := jwt.ParseWithClaims(assertion, &claims, func(*jwt.Token) (any, error) {
+		return key.Key.Public(), nil
+	}, jwt.WithAudience(audience), jwt.WithIssuer("client id"), jwt.WithExpirationRequired())
+	require.NoError(t, err)
+	assert.Equal(t, key.KeyID, tok.Header["kid"])
+	assert.Equal(t, "client id", claims.Subject)
+	assert.NotEmpty(t, claims.ID)
+}
+
+func TestExchangeCode_PrivateKeyJWT(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	idp.AccessToken = "at"
+	keys, err := ParseSigningKeys(append(testECKeyPEM(t, elliptic.P384()), testRSAKeyPEM(t, 2048, nil)...))
+	require.NoError(t, err)
+	client := newKeyClient(t, idp, keys)
+
+	tok, err := client.ExchangeCode(context.Background(), "code", "verifier", "http://127.0.0.1:1234/creds")
+	require.NoError(t, err)
+	assert.Equal(t, "at", tok.AccessToken)
+
+	reqs := idp.TokenRequests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "client id", reqs[0].Get("client_id"))
+	assert.Empty(t, reqs[0].Get("client_secret"))
+	assert.Equal(t, ClientAssertionType, reqs[0].Get("client_assertion_type"))
+	verifyAssertion(t, reqs[0].Get("client_assertion"), keys[0], idp.URL+"/token")
+}
+
+func TestPushAuthorizationRequest_PrivateKeyJWT(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	idp.PAR = true
+	keys, err := ParseSigningKeys(testRSAKeyPEM(t, 2048, map[string]string{"kid": "k1"}))
+	require.NoError(t, err)
+	client := newKeyClient(t, idp, keys)
+
+	_, err = client.PushAuthorizationRequest(context.Background(), "http://127.0.0.1:1234/creds", "st")
+	require.NoError(t, err)
+	pushed := idp.Pushed()
+	require.Len(t, pushed, 1)
+	assert.Empty(t, pushed[0].Get("client_secret"))
+	assert.Equal(t, ClientAssertionType, pushed[0].Get("client_assertion_type"))
+	verifyAssertion(t, pushed[0].Get("client_assertion"), keys[0], idp.URL+"/token")
+
+	t.Run("no keys", func(t *testing.T) {
+		_, err := newKeyClient(t, idp, nil).PushAuthorizationRequest(context.Background(), "http://127.0.0.1:1234/creds", "st")
+		assert.ErrorContains(t, err, "no client keys configured")
+	})
+}
@@ -2,6 +2,14 @@ package oidc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -13,6 +21,42 @@ import (
 type OIDCClient interface {
 	NewConfig(redirectURI string) *oauth2.Config
 	ExchangeCode(ctx context.Context, code, verifier, redirectURI string) (*oauth2.Token, error)
+	SupportsPAR() bool
+	PushAuthorizationRequest(ctx context.Context, redirectURI, state string, opts ...oauth2.AuthCodeOption) (string, error)
+	VerifyIDToken(ctx context.Context, rawIDToken, accessToken string) (*IDToken, error)
+	UserInfo(ctx context.Context, accessToken string) (*UserInfo, error)
+}
+
+// ErrUserInfoNotSupported is returned by UserInfo if the provider does not
+// advertise a userinfo endpoint.
+var ErrUserInfoNotSupported = errors.New("provider does not support userinfo")
+
+// IDToken is an ID token whose signature, issuer, audience and expiry have
+// been verified.
+type IDToken struct {
+	Issuer          string
+	Subject         string
+	Nonce           string
+	AccessTokenHash string
+	// RawClaims is the JSON payload of the token.
+	RawClaims json.RawMessage
+}
+
+// Claims unmarshals the token's claims into v.
+func (t *IDToken) Claims(v any) error {
+	return json.Unmarshal(t.RawClaims, v)
+}
+
+// UserInfo holds the claims returned by the userinfo endpoint.
+type UserInfo struct {
+	Subject string
+	// RawClaims is the JSON response of the endpoint.
+	RawClaims json.RawMessage
+}
+
+// Claims unmarshals the userinfo claims into v.
+func (u *UserInfo) Claims(v any) error {
+	return json.Unmarshal(u.RawClaims, v)
 }
 
 // oidcClient holds OIDC provider and client credentials
@@ -21,27 +65,263 @@ type oidcClient struct {
 	Provider     *coreosoidc.Provider
 	ClientID     string
 	ClientSecret string
+	// Secret, if set, supplies the client secret in place of ClientSecret
+	// whenever the client authenticates, so that it can rotate.
+	Secret func(ctx context.Context) (string, error)
+	// Keys, if set, selects private_key_jwt client authentication (RFC
+	// 7523) with the first of the returned keys instead of a client secret.
+	Keys func(ctx context.Context) ([]SigningKey, error)
+	// Scopes are requested in addition to openid, profile and email.
+	Scopes []string
 }
 
 // NewOIDCClient constructs a new oidcClient and returns it as OIDCClient
-func NewOIDCClient(provider *coreosoidc.Provider, clientID, clientSecret string) OIDCClient {
+func NewOIDCClient(provider *coreosoidc.Provider, clientID, clientSecret string, scopes ...string) OIDCClient {
 	return &oidcClient{
 		Provider:     provider,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
+		Scopes:       scopes,
+	}
+}
+
+// NewOIDCClientWithSecret is like NewOIDCClient, but obtains the client
+// secret from secret each time it is needed.
+func NewOIDCClientWithSecret(provider *coreosoidc.Provider, clientID string, secret func(ctx context.Context) (string, error), scopes ...string) OIDCClient {
+	return &oidcClient{
+		Provider: provider,
+		ClientID: clientID,
+		Secret:   secret,
+		Scopes:   scopes,
+	}
+}
+
+// NewOIDCClientWithKeys is like NewOIDCClient, but authenticates the client
+// with assertions signed by the first of the keys instead of a secret.
+func NewOIDCClientWithKeys(provider *coreosoidc.Provider, clientID string, keys func(ctx context.Context) ([]SigningKey, error), scopes ...string) OIDCClient {
+	return &oidcClient{
+		Provider: provider,
+		ClientID: clientID,
+		Keys:     keys,
+		Scopes:   scopes,
 	}
 }
 
+// clientSecret returns the current client secret.
+func (c *oidcClient) clientSecret(ctx context.Context) (string, error) {
+	if c.Secret == nil {
+		return c.ClientSecret, nil
+	}
+	secret, err := c.Secret(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain client secret: %w", err)
+	}
+	return secret, nil
+}
+
 func (c *oidcClient) NewConfig(redirectURI string) *oauth2.Config {
+	scopes := []string{coreosoidc.ScopeOpenID, "profile", "email"}
+	for _, s := range c.Scopes {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
 	return &oauth2.Config{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		Endpoint:     c.Provider.Endpoint(),
 		RedirectURL:  redirectURI,
-		Scopes:       []string{coreosoidc.ScopeOpenID, "profile", "email"},
+		Scopes:       scopes,
 	}
 }
 
 func (c *oidcClient) ExchangeCode(ctx context.Context, code, verifier, redirectURI string) (*oauth2.Token, error) {
-	return c.NewConfig(redirectURI).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	config := c.NewConfig(redirectURI)
+	opts := []oauth2.AuthCodeOption{oauth2.VerifierOption(verifier)}
+	if c.Keys != nil {
+		assertion, err := c.clientAssertion(ctx)
+		if err != nil {
+			return nil, err
+		}
+		config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+		opts = append(opts,
+			oauth2.SetAuthURLParam("client_assertion_type", ClientAssertionType),
+			oauth2.SetAuthURLParam("client_assertion", assertion),
+		)
+	} else {
+		secret, err := c.clientSecret(ctx)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientSecret = secret
+	}
+	return config.Exchange(ctx, code, opts...)
+}
+
+// clientAssertion signs a client assertion with the current key.  The
+// audience is the token endpoint, which RFC 9126 requires the PAR endpoint
+// to accept as well.
+func (c *oidcClient) clientAssertion(ctx context.Context) (string, error) {
+	keys, err := c.Keys(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load client keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return "", errors.New("no client keys configured")
+	}
+	return clientAssertion(keys[0], c.ClientID, c.Provider.Endpoint().TokenURL)
+}
+
+// VerifyIDToken verifies rawIDToken against the provider's keys and this
+// client's ID.  If the token carries an at_hash claim, it must match accessToken.
+func (c *oidcClient) VerifyIDToken(ctx context.Context, rawIDToken, accessToken string) (*IDToken, error) {
+	tok, err := c.Provider.Verifier(&coreosoidc.Config{ClientID: c.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if tok.AccessTokenHash != "" {
+		if err := tok.VerifyAccessToken(accessToken); err != nil {
+			return nil, err
+		}
+	}
+	var raw json.RawMessage
+	if err := tok.Claims(&raw); err != nil {
+		return nil, err
+	}
+	return &IDToken{
+		Issuer:          tok.Issuer,
+		Subject:         tok.Subject,
+		Nonce:           tok.Nonce,
+		AccessTokenHash: tok.AccessTokenHash,
+		RawClaims:       raw,
+	}, nil
+}
+
+// UserInfo fetches the user's claims from the provider's userinfo endpoint
+// with the access token from ExchangeCode.
+func (c *oidcClient) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	if c.Provider.UserInfoEndpoint() == "" {
+		return nil, ErrUserInfoNotSupported
+	}
+	info, err := c.Provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	if err := info.Claims(&raw); err != nil {
+		return nil, err
+	}
+	return &UserInfo{Subject: info.Subject, RawClaims: raw}, nil
+}
+
+// providerMetadata holds discovery fields not exposed by coreosoidc.Provider.
+type providerMetadata struct {
+	PAREndpoint string `json:"pushed_authorization_request_endpoint"`
+}
+
+func (c *oidcClient) metadata() providerMetadata {
+	var m providerMetadata
+	_ = c.Provider.Claims(&m) // missing claims leave the zero value
+	return m
+}
+
+// SupportsPAR reports whether the provider advertises a pushed authorization
+// request endpoint (RFC 9126).
+func (c *oidcClient) SupportsPAR() bool {
+	return c.metadata().PAREndpoint != ""
+}
+
+// parResponse is the pushed authorization response (RFC 9126, section 2.2).
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// oauthError is an OAuth 2.0 error response body.
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// PushAuthorizationRequest pushes the authorization parameters to the
+// provider's PAR endpoint and returns an authorization URL that carries only
+// client_id and request_uri.
+func (c *oidcClient) PushAuthorizationRequest(ctx context.Context, redirectURI, state string, opts ...oauth2.AuthCodeOption) (string, error) {
+	endpoint := c.metadata().PAREndpoint
+	if endpoint == "" {
+		return "", errors.New("provider does not support pushed authorization requests")
+	}
+	config := c.NewConfig(redirectURI)
+
+	// Let oauth2 assemble the parameters exactly as it would for a front-channel request.
+	front, err := url.Parse(config.AuthCodeURL(state, opts...))
+	if err != nil {
+		return "", err
+	}
+	params := front.Query()
+
+	var secret string
+	if c.Keys != nil {
+		assertion, err := c.clientAssertion(ctx)
+		if err != nil {
+			return "", err
+		}
+		params.Set("client_assertion_type", ClientAssertionType)
+		params.Set("client_assertion", assertion)
+	} else if secret, err = c.clientSecret(ctx); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.Keys == nil {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(secret))
+	}
+
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		var oe oauthError
+		if json.Unmarshal(body, &oe) == nil && oe.Error != "" {
+			return "", fmt.Errorf("pushed authorization request: %s: %s", oe.Error, oe.Description)
+		}
+		return "", fmt.Errorf("pushed authorization request: unexpected status %d", resp.StatusCode)
+	}
+	var par parResponse
+	if err := json.Unmarshal(body, &par); err != nil {
+		return "", fmt.Errorf("pushed authorization request: %w", err)
+	}
+	if par.RequestURI == "" {
+		return "", errors.New("pushed authorization request: no request_uri in response")
+	}
+
+	authURL, err := url.Parse(config.Endpoint.AuthURL)
+	if err != nil {
+		return "", err
+	}
+	q := authURL.Query()
+	q.Set("client_id", c.ClientID)
+	q.Set("request_uri", par.RequestURI)
+	authURL.RawQuery = q.Encode()
+	return authURL.String(), nil
+}
+
+// httpClient returns the client configured via oauth2.HTTPClient, as the
+// oauth2 package does for token requests.
+func httpClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
 }
@@ -0,0 +1,179 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func newFakeClient(t *testing.T, idp *FakeIdP) OIDCClient {
+	provider, err := coreosoidc.NewProvider(context.Background(), idp.URL)
+	require.NoError(t, err)
+	return NewOIDCClient(provider, "client id", "secret")
+}
+
+func TestSupportsPAR(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	assert.False(t, newFakeClient(t, idp).SupportsPAR())
+
+	idp.PAR = true
+	assert.True(t, newFakeClient(t, idp).SupportsPAR())
+
+	assert.False(t, NewOIDCClient(&coreosoidc.Provider{}, "id", "secret").SupportsPAR())
+}
+
+func TestPushAuthorizationRequest(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	idp.PAR = true
+	client := newFakeClient(t, idp)
+
+	authURL, err := client.PushAuthorizationRequest(context.Background(), "http://127.0.0.1:1234/creds", "st",
+		oauth2.SetAuthURLParam("code_challenge", "chal"))
+	require.NoError(t, err)
+
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, idp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, url.Values{
+		"client_id":   {"client id"},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:fake"},
+	}, u.Query())
+
+	pushed := idp.Pushed()
+	require.Len(t, pushed, 1)
+	assert.Equal(t, "client id", pushed[0].Get("client_id"))
+	assert.Equal(t, "secret", pushed[0].Get("client_secret"))
+	assert.Equal(t, "code", pushed[0].Get("response_type"))
+	assert.Equal(t, "st", pushed[0].Get("state"))
+	assert.Equal(t, "chal", pushed[0].Get("code_challenge"))
+	assert.Equal(t, "http://127.0.0.1:1234/creds", pushed[0].Get("redirect_uri"))
+}
+
+func TestPushAuthorizationRequest_Errors(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+
+	_, err := newFakeClient(t, idp).PushAuthorizationRequest(context.Background(), "r", "st")
+	assert.ErrorContains(t, err, "does not support pushed authorization requests")
+
+	idp.PAR = true
+	idp.PARError = "invalid_request"
+	_, err = newFakeClient(t, idp).PushAuthorizationRequest(context.Background(), "r", "st")
+	assert.ErrorContains(t, err, "invalid_request: rejected by fake IdP")
+}
+
+// atHash computes the at_hash claim for an RS256-signed ID token.
+func atHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	client := newFakeClient(t, idp)
+	ctx := context.Background()
+
+	raw := idp.IssueIDToken(map[string]any{"aud": "client id", "sub": "u1", "nonce": "n", "email": "foo@bar.com"})
+	tok, err := client.VerifyIDToken(ctx, raw, "at")
+	require.NoError(t, err)
+	assert.Equal(t, idp.URL, tok.Issuer)
+	assert.Equal(t, "u1", tok.Subject)
+	assert.Equal(t, "n", tok.Nonce)
+	var claims struct {
+		Email string `json:"email"`
+	}
+	require.NoError(t, tok.Claims(&claims))
+	assert.Equal(t, "foo@bar.com", claims.Email)
+
+	t.Run("at_hash matches", func(t *testing.T) {
+		raw := idp.IssueIDToken(map[string]any{"aud": "client id", "sub": "u1", "at_hash": atHash("at")})
+		_, err := client.VerifyIDToken(ctx, raw, "at")
+		assert.NoError(t, err)
+	})
+	t.Run("at_hash mismatch", func(t *testing.T) {
+		raw := idp.IssueIDToken(map[string]any{"aud": "client id", "sub": "u1", "at_hash": atHash("other")})
+		_, err := client.VerifyIDToken(ctx, raw, "at")
+		assert.Error(t, err)
+	})
+	t.Run("wrong audience", func(t *testing.T) {
+		raw := idp.IssueIDToken(map[string]any{"aud": "someone else", "sub": "u1"})
+		_, err := client.VerifyIDToken(ctx, raw, "at")
+		assert.Error(t, err)
+	})
+	t.Run("foreign signature", func(t *testing.T) {
+		other := NewFakeIdP()
+		defer other.Close()
+		raw := other.IssueIDToken(map[string]any{"iss": idp.URL, "aud": "client id", "sub": "u1"})
+		_, err := client.VerifyIDToken(ctx, raw, "at")
+		assert.Error(t, err)
+	})
+}
+
+func TestNewConfig_Scopes(t *testing.T) {
+	c := NewOIDCClient(&coreosoidc.Provider{}, "id", "secret", "groups", "email")
+	assert.Equal(t, []string{"openid", "profile", "email", "groups"}, c.NewConfig("http://127.0.0.1:1/creds").Scopes)
+}
+
+func TestUserInfo(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	idp.AccessToken = "at"
+	idp.UserInfo = map[string]any{"sub": "u1", "email": "foo@bar.com"}
+	client := newFakeClient(t, idp)
+	ctx := context.Background()
+
+	info, err := client.UserInfo(ctx, "at")
+	require.NoError(t, err)
+	assert.Equal(t, "u1", info.Subject)
+	var claims struct {
+		Email string `json:"email"`
+	}
+	require.NoError(t, info.Claims(&claims))
+	assert.Equal(t, "foo@bar.com", claims.Email)
+
+	t.Run("invalid access token", func(t *testing.T) {
+		_, err := client.UserInfo(ctx, "other")
+		assert.Error(t, err)
+	})
+	t.Run("not supported", func(t *testing.T) {
+		_, err := NewOIDCClient(&coreosoidc.Provider{}, "id", "secret").UserInfo(ctx, "at")
+		assert.ErrorIs(t, err, ErrUserInfoNotSupported)
+	})
+}
+
+func TestPushAuthorizationRequest_RotatingSecret(t *testing.T) {
+	idp := NewFakeIdP()
+	defer idp.Close()
+	idp.PAR = true
+	provider, err := coreosoidc.NewProvider(context.Background(), idp.URL)
+	require.NoError(t, err)
+	secret := "v1"
+	client := NewOIDCClientWithSecret(provider, "client id", func(context.Context) (string, error) {
+		return secret, nil
+	})
+
+	for _, want := range []string{"v1", "v2"} {
+		secret = want
+		_, err := client.PushAuthorizationRequest(context.Background(), "http://127.0.0.1:1234/creds", "st")
+		require.NoError(t, err)
+		pushed := idp.Pushed()
+		assert.Equal(t, want, pushed[len(pushed)-1].Get("client_secret"))
+	}
+
+	failing := NewOIDCClientWithSecret(provider, "client id", func(context.Context) (string, error) {
+		return "", errors.New("unavailable")
+	})
+	_, err = failing.PushAuthorizationRequest(context.Background(), "http://127.0.0.1:1234/creds", "st")
+	assert.ErrorContains(t, err, "failed to obtain client secret: unavailable")
+}
@@ -0,0 +1,195 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdPKeyID identifies the FakeIdP signing key in its JWKS.
+const fakeIdPKeyID = "fake"
+
+// FakeIdP is a minimal OIDC provider for tests.  It serves discovery and the
+// endpoints exercised by oidcClient.
+type FakeIdP struct {
+	*httptest.Server
+
+	// PAR advertises the pushed authorization request endpoint in discovery.
+	PAR bool
+	// PARError, if set, is returned as the OAuth error from the PAR endpoint.
+	PARError string
+	// UserInfo holds the claims served to requests bearing AccessToken.
+	UserInfo    map[string]any
+	AccessToken string
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	pushed []url.Values
+	tokens []url.Values
+}
+
+// NewFakeIdP starts a FakeIdP.  Callers must Close it.
+func NewFakeIdP() *FakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	f := &FakeIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/jwks", f.jwks)
+	mux.HandleFunc("/par", f.par)
+	mux.HandleFunc("/token", f.token)
+	mux.HandleFunc("/userinfo", f.userinfo)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Pushed returns the parameters of the pushed authorization requests received so far.
+func (f *FakeIdP) Pushed() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.pushed...)
+}
+
+// TokenRequests returns the parameters of the token requests received so far.
+func (f *FakeIdP) TokenRequests() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.tokens...)
+}
+
+// IssueIDToken signs an ID token with the given claims.  iss, iat and exp
+// default to this provider and a one hour lifetime.
+func (f *FakeIdP) IssueIDToken(claims map[string]any) string {
+	c := jwt.MapClaims{
+		"iss": f.URL,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tok.Header["kid"] = fakeIdPKeyID
+	s, err := tok.SignedString(f.key)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (f *FakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	doc := map[string]any{
+		"issuer":                 f.URL,
+		"authorization_endpoint": f.URL + "/authorize",
+		"token_endpoint":         f.URL + "/token",
+		"jwks_uri":               f.URL + "/jwks",
+		"userinfo_endpoint":      f.URL + "/userinfo",
+	}
+	if f.PAR {
+		doc["pushed_authorization_request_endpoint"] = f.URL + "/par"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(doc)
+}
+
+func (f *FakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := f.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": fakeIdPKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (f *FakeIdP) par(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := clientParams(r)
+	f.mu.Lock()
+	f.pushed = append(f.pushed, params)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if f.PARError != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": f.PARError, "error_description": "rejected by fake IdP"})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"request_uri": "urn:ietf:params:oauth:request_uri:fake",
+		"expires_in":  60,
+	})
+}
+
+func (f *FakeIdP) userinfo(w http.ResponseWriter, r *http.Request) {
+	if f.AccessToken == "" || r.Header.Get("Authorization") != "Bearer "+f.AccessToken {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.UserInfo)
+}
+
+// token redeems any code for AccessToken and an ID token for the client.
+func (f *FakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := clientParams(r)
+	f.mu.Lock()
+	f.tokens = append(f.tokens, params)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": f.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     f.IssueIDToken(map[string]any{"aud": params.Get("client_id"), "sub": "u1"}),
+	})
+}
+
+// clientParams returns the form parameters of r, with HTTP basic client
+// credentials moved into client_id and client_secret.
+func clientParams(r *http.Request) url.Values {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return r.PostForm
+	}
+	params := url.Values{}
+	for k, v := range r.PostForm {
+		params[k] = v
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	params.Set("client_id", id)
+	params.Set("client_secret", secret)
+	return params
+}
@@ -2,13 +2,17 @@ package oidc
 
 import (
 	"context"
+	"encoding/json"
 
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/oauth2"
 )
 
 type MockOIDCClient struct {
 	OIDCClient
-	ExchangeCodeFunc func(ctx context.Context, code, verifier, redirectURI string) (*oauth2.Token, error)
+	ExchangeCodeFunc  func(ctx context.Context, code, verifier, redirectURI string) (*oauth2.Token, error)
+	VerifyIDTokenFunc func(ctx context.Context, rawIDToken, accessToken string) (*IDToken, error)
+	UserInfoFunc      func(ctx context.Context, accessToken string) (*UserInfo, error)
 }
 
 var _ OIDCClient = (*MockOIDCClient)(nil)
@@ -21,3 +25,33 @@ func (m *MockOIDCClient) ExchangeCode(ctx context.Context, code, verifier, redir
 	tok = tok.WithExtra(map[string]any{"id_token": "mockIDToken"})
 	return tok, nil
 }
+
+// VerifyIDToken decodes the token without checking its signature, unless
+// VerifyIDTokenFunc is set.
+func (m *MockOIDCClient) VerifyIDToken(ctx context.Context, rawIDToken, accessToken string) (*IDToken, error) {
+	if m.VerifyIDTokenFunc != nil {
+		return m.VerifyIDTokenFunc(ctx, rawIDToken, accessToken)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(rawIDToken, claims); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	tok := &IDToken{RawClaims: raw}
+	tok.Issuer, _ = claims.GetIssuer()
+	tok.Subject, _ = claims.GetSubject()
+	tok.Nonce, _ = claims["nonce"].(string)
+	tok.AccessTokenHash, _ = claims["at_hash"].(string)
+	return tok, nil
+}
+
+// UserInfo reports ErrUserInfoNotSupported, unless UserInfoFunc is set.
+func (m *MockOIDCClient) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	if m.UserInfoFunc != nil {
+		return m.UserInfoFunc(ctx, accessToken)
+	}
+	return nil, ErrUserInfoNotSupported
+}
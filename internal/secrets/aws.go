@@ -0,0 +1,66 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SSMAPI is the subset of the SSM client used by SSMSource.
+type SSMAPI interface {
+	GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// SecretsManagerAPI is the subset of the Secrets Manager client used by
+// SecretsManagerSource.
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// SSMSource reads SSM parameters by name, e.g. ssm:/aws-oidc/client-secret.
+// SecureString parameters are decrypted.
+func SSMSource(client SSMAPI) Source {
+	return SourceFunc(func(ctx context.Context, name string) (string, error) {
+		out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		}
+		if out.Parameter == nil || out.Parameter.Value == nil {
+			return "", errors.New("parameter has no value")
+		}
+		return *out.Parameter.Value, nil
+	})
+}
+
+// SecretsManagerSource reads the current string value of a secret by name
+// or ARN, e.g. secretsmanager:arn:aws:secretsmanager:...:secret:aws-oidc.
+func SecretsManagerSource(client SecretsManagerAPI) Source {
+	return SourceFunc(func(ctx context.Context, name string) (string, error) {
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(name),
+		})
+		if err != nil {
+			return "", err
+		}
+		if out.SecretString == nil {
+			return "", errors.New("secret has no string value")
+		}
+		return *out.SecretString, nil
+	})
+}
+
+// DefaultSources returns the ssm, secretsmanager and file sources, using
+// cfg for the AWS clients.
+func DefaultSources(cfg aws.Config) map[string]Source {
+	return map[string]Source{
+		"ssm":            SSMSource(ssm.NewFromConfig(cfg)),
+		"secretsmanager": SecretsManagerSource(secretsmanager.NewFromConfig(cfg)),
+		"file":           FileSource,
+	}
+}
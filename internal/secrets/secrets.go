@@ -0,0 +1,110 @@
+// Package secrets resolves secret references in configuration values, such
+// as ssm:/aws-oidc/client-secret, so that secrets need not be stored in
+// plaintext environment variables.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source fetches the current value of a secret.  name is the reference
+// without its scheme prefix.
+type Source interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// SourceFunc adapts a function to Source.
+type SourceFunc func(ctx context.Context, name string) (string, error)
+
+// Get calls f.
+func (f SourceFunc) Get(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
+
+// FileSource reads secrets from files, e.g. file:/run/secrets/client-secret.
+// A trailing newline is removed.
+var FileSource = SourceFunc(func(_ context.Context, name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+})
+
+// Resolver resolves references of the form <scheme>:<name> through the
+// Source registered for the scheme.  Values without a registered scheme are
+// returned as is.  Resolved values are cached for RefreshInterval, after
+// which they are fetched again on next use, so that rotated secrets are
+// picked up.  If a refresh fails, the previous value is kept.
+type Resolver struct {
+	// Sources maps schemes, such as "ssm", to their Source.
+	Sources map[string]Source
+	// RefreshInterval is how long resolved values are cached.  Zero caches
+	// them for the lifetime of the Resolver.
+	RefreshInterval time.Duration
+
+	now   func() time.Time
+	mu    sync.Mutex
+	cache map[string]cachedValue
+}
+
+type cachedValue struct {
+	value   string
+	fetched time.Time
+}
+
+// NewResolver returns a Resolver for the given sources.
+func NewResolver(sources map[string]Source, refreshInterval time.Duration) *Resolver {
+	return &Resolver{
+		Sources:         sources,
+		RefreshInterval: refreshInterval,
+		now:             time.Now,
+		cache:           map[string]cachedValue{},
+	}
+}
+
+// IsRef reports whether value is a reference the Resolver would resolve.
+func (r *Resolver) IsRef(value string) bool {
+	scheme, _, ok := strings.Cut(value, ":")
+	_, known := r.Sources[scheme]
+	return ok && known
+}
+
+// Resolve returns the value a reference refers to, or value itself if it is
+// not a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !r.IsRef(value) {
+		return value, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cached, ok := r.cache[value]
+	if ok && (r.RefreshInterval == 0 || r.now().Sub(cached.fetched) < r.RefreshInterval) {
+		return cached.value, nil
+	}
+	scheme, name, _ := strings.Cut(value, ":")
+	v, err := r.Sources[scheme].Get(ctx, name)
+	if err != nil {
+		if ok {
+			log.Printf("failed to refresh secret %s, keeping previous value: %v", value, err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("failed to resolve secret %s: %w", value, err)
+	}
+	r.cache[value] = cachedValue{value: v, fetched: r.now()}
+	return v, nil
+}
+
+// Func returns a function resolving value on each call, for consumers that
+// should see rotated secrets.
+func (r *Resolver) Func(value string) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		return r.Resolve(ctx, value)
+	}
+}
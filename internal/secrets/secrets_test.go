@@ -0,0 +1,130 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource serves values from a map and counts fetches.
+type fakeSource struct {
+	values map[string]string
+	err    error
+	calls  int
+}
+
+func (f *fakeSource) Get(_ context.Context, name string) (string, error) {
+	f.calls++
+	if f.err != nil {
+		return "", f.err
+	}
+	v, ok := f.values[name]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return v, nil
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	src := &fakeSource{values: map[string]string{"/app/secret": "s3cret"}}
+	r := NewResolver(map[string]Source{"ssm": src}, 0)
+	ctx := context.Background()
+
+	v, err := r.Resolve(ctx, "ssm:/app/secret")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", v)
+
+	v, err = r.Resolve(ctx, "plain value")
+	require.NoError(t, err)
+	assert.Equal(t, "plain value", v)
+
+	v, err = r.Resolve(ctx, "unknown:scheme")
+	require.NoError(t, err)
+	assert.Equal(t, "unknown:scheme", v, "unregistered schemes are literals")
+
+	_, err = r.Resolve(ctx, "ssm:/missing")
+	assert.ErrorContains(t, err, "failed to resolve secret ssm:/missing: not found")
+
+	_, _ = r.Resolve(ctx, "ssm:/app/secret")
+	assert.Equal(t, 2, src.calls, "cached without refresh interval")
+}
+
+func TestResolver_Refresh(t *testing.T) {
+	src := &fakeSource{values: map[string]string{"/app/secret": "v1"}}
+	r := NewResolver(map[string]Source{"ssm": src}, time.Minute)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	v, _ := r.Resolve(ctx, "ssm:/app/secret")
+	assert.Equal(t, "v1", v)
+
+	src.values["/app/secret"] = "v2"
+	now = now.Add(30 * time.Second)
+	v, _ = r.Resolve(ctx, "ssm:/app/secret")
+	assert.Equal(t, "v1", v, "still cached")
+
+	now = now.Add(time.Minute)
+	v, _ = r.Resolve(ctx, "ssm:/app/secret")
+	assert.Equal(t, "v2", v, "refreshed")
+
+	src.err = errors.New("throttled")
+	now = now.Add(2 * time.Minute)
+	v, err := r.Resolve(ctx, "ssm:/app/secret")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", v, "previous value kept on refresh failure")
+	assert.Equal(t, 3, src.calls)
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0o600))
+	r := NewResolver(map[string]Source{"file": FileSource}, 0)
+	v, err := r.Resolve(context.Background(), "file:"+path)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", v)
+}
+
+type fakeSSM struct{ in *ssm.GetParameterInput }
+
+func (f *fakeSSM) GetParameter(_ context.Context, in *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.in = in
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String("from-ssm")}}, nil
+}
+
+type fakeSecretsManager struct {
+	out *secretsmanager.GetSecretValueOutput
+}
+
+func (f *fakeSecretsManager) GetSecretValue(_ context.Context, in *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	return f.out, nil
+}
+
+func TestAWSSources(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeSSM{}
+	v, err := SSMSource(client).Get(ctx, "/app/secret")
+	require.NoError(t, err)
+	assert.Equal(t, "from-ssm", v)
+	assert.Equal(t, "/app/secret", aws.ToString(client.in.Name))
+	assert.True(t, aws.ToBool(client.in.WithDecryption))
+
+	sm := &fakeSecretsManager{out: &secretsmanager.GetSecretValueOutput{SecretString: aws.String("from-sm")}}
+	v, err = SecretsManagerSource(sm).Get(ctx, "arn:aws:secretsmanager:us-east-1:1:secret:app")
+	require.NoError(t, err)
+	assert.Equal(t, "from-sm", v)
+
+	sm.out = &secretsmanager.GetSecretValueOutput{SecretBinary: []byte{1}}
+	_, err = SecretsManagerSource(sm).Get(ctx, "app")
+	assert.ErrorContains(t, err, "no string value")
+}